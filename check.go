@@ -0,0 +1,42 @@
+package msgpgen
+
+import (
+	"fmt"
+	"strings"
+
+	"github.com/pmezard/go-difflib/difflib"
+)
+
+// StaleFile is a destination file whose contents do not match what the
+// generator would produce.
+type StaleFile struct {
+	Path string
+
+	// Unified diff from the file on disk to the generated contents. Only
+	// populated if Config.Diff is set.
+	Diff string
+}
+
+// StaleError is returned by Generate in check mode if any of the generated
+// files differ from the files on disk.
+type StaleError struct {
+	Files []StaleFile
+}
+
+func (s *StaleError) Error() string {
+	paths := make([]string, len(s.Files))
+	for i, f := range s.Files {
+		paths[i] = f.Path
+	}
+	return fmt.Sprintf("generated files are out of date:\n  %s", strings.Join(paths, "\n  "))
+}
+
+func unifiedDiff(path string, current, generated []byte) (string, error) {
+	return difflib.GetUnifiedDiffString(difflib.UnifiedDiff{
+		A:        difflib.SplitLines(string(current)),
+		B:        difflib.SplitLines(string(generated)),
+		FromFile: path,
+		ToFile:   path + " (generated)",
+		Context:  3,
+	})
+}
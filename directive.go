@@ -3,6 +3,7 @@ package msgpgen
 import (
 	"fmt"
 	"regexp"
+	"strconv"
 	"strings"
 
 	"github.com/pkg/errors"
@@ -65,6 +66,18 @@ func ParseDirective(input string) (Directive, error) {
 		directive = &TupleDirective{}
 	case "allowextra":
 		directive = &AllowExtraDirective{}
+	case "formerly":
+		directive = &FormerlyDirective{}
+	case "typeid":
+		directive = &TypeIDDirective{}
+	case "discriminator":
+		directive = &DiscriminatorDirective{}
+	case "envelope":
+		directive = &EnvelopeDirective{}
+	case "open":
+		directive = &OpenDirective{}
+	case "unknown":
+		directive = &UnknownDirective{}
 	default:
 		return nil, fmt.Errorf("unknown directive %s", dir)
 	}
@@ -164,6 +177,180 @@ func (i AllowExtraDirective) Build(tpset *structer.TypePackageSet, pkg string) (
 	return "//msgp:allowextra " + strings.Join(ts, " "), nil
 }
 
+//msgp:formerly {Type} {old/pkg.Name}...
+type FormerlyDirective struct {
+	Type     string
+	Formerly []string
+}
+
+func (i *FormerlyDirective) Populate(args []string, kwargs map[string]string) error {
+	if len(kwargs) > 0 {
+		return errors.Errorf("invalid kwargs for formerly")
+	}
+	if len(args) < 2 {
+		return errors.Errorf("invalid formerly directive - expected a type followed by at least one former name, found %d args", len(args))
+	}
+	i.Type = args[0]
+	i.Formerly = args[1:]
+	return nil
+}
+
+// Build returns nothing; formerly is only used by msgpgen to carry a type's
+// ID across a rename or move.
+func (i FormerlyDirective) Build(tpset *structer.TypePackageSet, pkg string) (string, error) {
+	return "", nil
+}
+
+//msgp:typeid {Type} {ID}
+type TypeIDDirective struct {
+	Type string
+	ID   int
+}
+
+func (i *TypeIDDirective) Populate(args []string, kwargs map[string]string) error {
+	if len(kwargs) > 0 {
+		return errors.Errorf("invalid kwargs for typeid")
+	}
+	if len(args) != 2 {
+		return errors.Errorf("invalid typeid directive - expected a type and an ID, found %d args", len(args))
+	}
+	id, err := strconv.Atoi(args[1])
+	if err != nil || id <= 0 {
+		return errors.Errorf("invalid typeid directive - ID %q must be a positive integer", args[1])
+	}
+	i.Type = args[0]
+	i.ID = id
+	return nil
+}
+
+// Build returns nothing; typeid is only used by msgpgen to pin the ID the
+// type is given in the state file.
+func (i TypeIDDirective) Build(tpset *structer.TypePackageSet, pkg string) (string, error) {
+	return "", nil
+}
+
+//msgp:discriminator {Iface} as:{int|string|name} accept:{int|string|name,...}
+type DiscriminatorDirective struct {
+	Type   string
+	As     Discriminator
+	Accept []Discriminator
+}
+
+func (i *DiscriminatorDirective) Populate(args []string, kwargs map[string]string) error {
+	if len(args) != 1 {
+		return errors.Errorf("invalid discriminator directive - expected an interface, found %d args", len(args))
+	}
+	i.Type = args[0]
+
+	for k, v := range kwargs {
+		switch k {
+		case "as":
+			i.As = Discriminator(v)
+			if !i.As.valid() {
+				return errors.Errorf("invalid discriminator directive - unknown encoding %q", v)
+			}
+		case "accept":
+			for _, a := range strings.Split(v, ",") {
+				d := Discriminator(a)
+				if !d.valid() {
+					return errors.Errorf("invalid discriminator directive - unknown encoding %q", a)
+				}
+				i.Accept = append(i.Accept, d)
+			}
+		default:
+			return errors.Errorf("invalid discriminator directive - unknown kwarg %q", k)
+		}
+	}
+	if i.As == "" {
+		return errors.Errorf("invalid discriminator directive - missing as:")
+	}
+	return nil
+}
+
+// Build returns nothing; the discriminator is used by msgpgen when it
+// generates the interface's interceptor.
+func (i DiscriminatorDirective) Build(tpset *structer.TypePackageSet, pkg string) (string, error) {
+	return "", nil
+}
+
+//msgp:envelope {Iface} layout:{array|map|flat}
+type EnvelopeDirective struct {
+	Type   string
+	Layout Envelope
+}
+
+func (i *EnvelopeDirective) Populate(args []string, kwargs map[string]string) error {
+	if len(args) != 1 {
+		return errors.Errorf("invalid envelope directive - expected an interface, found %d args", len(args))
+	}
+	i.Type = args[0]
+
+	for k, v := range kwargs {
+		switch k {
+		case "layout":
+			i.Layout = Envelope(v)
+			if !i.Layout.valid() {
+				return errors.Errorf("invalid envelope directive - unknown layout %q", v)
+			}
+		default:
+			return errors.Errorf("invalid envelope directive - unknown kwarg %q", k)
+		}
+	}
+	if i.Layout == "" {
+		return errors.Errorf("invalid envelope directive - missing layout:")
+	}
+	return nil
+}
+
+// Build returns nothing; the envelope is used by msgpgen when it generates
+// the interface's interceptor.
+func (i EnvelopeDirective) Build(tpset *structer.TypePackageSet, pkg string) (string, error) {
+	return "", nil
+}
+
+//msgp:open {Iface}
+type OpenDirective struct {
+	Type string
+}
+
+func (i *OpenDirective) Populate(args []string, kwargs map[string]string) error {
+	if len(kwargs) > 0 {
+		return errors.Errorf("invalid kwargs for open")
+	}
+	if len(args) != 1 {
+		return errors.Errorf("invalid open directive - expected an interface, found %d args", len(args))
+	}
+	i.Type = args[0]
+	return nil
+}
+
+// Build returns nothing; msgpgen generates the interface's registry itself.
+func (i OpenDirective) Build(tpset *structer.TypePackageSet, pkg string) (string, error) {
+	return "", nil
+}
+
+//msgp:unknown {Iface}
+type UnknownDirective struct {
+	Type string
+}
+
+func (i *UnknownDirective) Populate(args []string, kwargs map[string]string) error {
+	if len(kwargs) > 0 {
+		return errors.Errorf("invalid kwargs for unknown")
+	}
+	if len(args) != 1 {
+		return errors.Errorf("invalid unknown directive - expected an interface, found %d args", len(args))
+	}
+	i.Type = args[0]
+	return nil
+}
+
+// Build returns nothing; msgpgen generates the type that holds unknown values
+// itself.
+func (i UnknownDirective) Build(tpset *structer.TypePackageSet, pkg string) (string, error) {
+	return "", nil
+}
+
 //msgp:shim {Type} using:{Func}
 type InterceptDirective struct {
 	Type  string
@@ -237,6 +424,12 @@ func (i ShimDirective) Build(tpset *structer.TypePackageSet, pkg string) (string
 	), nil
 }
 
+// String returns the directive as it would be written in the source, using
+// the type name as declared.
+func (i ShimDirective) String() string {
+	return fmt.Sprintf("//msgp:shim %s as:%s using:%s/%s mode:%s", i.Type, i.As, i.ToFunc, i.FromFunc, i.Mode)
+}
+
 func (i *ShimDirective) Populate(args []string, kwargs map[string]string) error {
 	var ok bool
 
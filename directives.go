@@ -1,6 +1,7 @@
 package msgpgen
 
 import (
+	"go/token"
 	"strings"
 
 	"github.com/pkg/errors"
@@ -23,17 +24,47 @@ type Directives struct {
 	allowextra map[structer.TypeName]string
 	shim       map[structer.TypeName]*ShimDirective
 	pkg        string
+
+	// Maps fully qualified type names to the fully qualified names they
+	// were formerly known by.
+	formerly map[structer.TypeName][]structer.TypeName
+
+	// Maps fully qualified type names to the ID pinned by a typeid directive.
+	typeid map[structer.TypeName]int
+
+	// Maps fully qualified interface names to their discriminator directive.
+	discriminator map[structer.TypeName]*DiscriminatorDirective
+
+	// Maps fully qualified interface names to their envelope layout.
+	envelope map[structer.TypeName]Envelope
+
+	// Fully qualified names of the interfaces that use an open registry.
+	open map[structer.TypeName]bool
+
+	// Fully qualified names of the interfaces that decode unknown IDs into
+	// a generated type instead of failing.
+	unknown map[structer.TypeName]bool
+
+	// directives that apply to every package, consulted after this package's
+	// own directives. may be nil.
+	global *Directives
 }
 
 func NewDirectives(tpset *structer.TypePackageSet, pkg string) *Directives {
 	d := &Directives{
-		tpset:       tpset,
-		ignore:      make(map[structer.TypeName]string),
-		intercepted: make(map[structer.TypeName]string),
-		tuple:       make(map[structer.TypeName]string),
-		allowextra:  make(map[structer.TypeName]string),
-		shim:        make(map[structer.TypeName]*ShimDirective),
-		pkg:         pkg,
+		tpset:         tpset,
+		ignore:        make(map[structer.TypeName]string),
+		intercepted:   make(map[structer.TypeName]string),
+		tuple:         make(map[structer.TypeName]string),
+		allowextra:    make(map[structer.TypeName]string),
+		shim:          make(map[structer.TypeName]*ShimDirective),
+		formerly:      make(map[structer.TypeName][]structer.TypeName),
+		typeid:        make(map[structer.TypeName]int),
+		discriminator: make(map[structer.TypeName]*DiscriminatorDirective),
+		envelope:      make(map[structer.TypeName]Envelope),
+		open:          make(map[structer.TypeName]bool),
+		unknown:       make(map[structer.TypeName]bool),
+		pkg:           pkg,
 	}
 	return d
 }
@@ -97,6 +128,62 @@ func (d *Directives) add(dirs ...Directive) error {
 				d.allowextra[tn] = t
 			}
 
+		case *FormerlyDirective:
+			tn, err := structer.ParseLocalName(dir.Type, d.pkg)
+			if err != nil {
+				return err
+			}
+			for _, f := range dir.Formerly {
+				ftn, err := structer.ParseTypeName(f)
+				if err != nil {
+					return errors.Wrapf(err, "formerly directive for %s: former names must be fully qualified", dir.Type)
+				}
+				d.formerly[tn] = append(d.formerly[tn], ftn)
+			}
+
+		case *TypeIDDirective:
+			tn, err := structer.ParseLocalName(dir.Type, d.pkg)
+			if err != nil {
+				return err
+			}
+			if cur, ok := d.typeid[tn]; ok && cur != dir.ID {
+				return errors.Errorf("%s is pinned to both ID %d and ID %d", dir.Type, cur, dir.ID)
+			}
+			for other, id := range d.typeid {
+				if id == dir.ID && other != tn {
+					return errors.Errorf("typeid %d is pinned to both %s and %s", id, other, tn)
+				}
+			}
+			d.typeid[tn] = dir.ID
+
+		case *DiscriminatorDirective:
+			tn, err := structer.ParseLocalName(dir.Type, d.pkg)
+			if err != nil {
+				return err
+			}
+			d.discriminator[tn] = dir
+
+		case *EnvelopeDirective:
+			tn, err := structer.ParseLocalName(dir.Type, d.pkg)
+			if err != nil {
+				return err
+			}
+			d.envelope[tn] = dir.Layout
+
+		case *OpenDirective:
+			tn, err := structer.ParseLocalName(dir.Type, d.pkg)
+			if err != nil {
+				return err
+			}
+			d.open[tn] = true
+
+		case *UnknownDirective:
+			tn, err := structer.ParseLocalName(dir.Type, d.pkg)
+			if err != nil {
+				return err
+			}
+			d.unknown[tn] = true
+
 		default:
 			return errors.Errorf("Unknown msgp directive %+v", dir)
 		}
@@ -104,6 +191,31 @@ func (d *Directives) add(dirs ...Directive) error {
 	return nil
 }
 
+// shimFor returns the shim directive for the type declared in this package,
+// or globally.
+func (d *Directives) shimFor(tn structer.TypeName) *ShimDirective {
+	if shim, ok := d.shim[tn]; ok {
+		return shim
+	}
+	if d.global != nil {
+		return d.global.shim[tn]
+	}
+	return nil
+}
+
+// isIgnored reports whether the type is ignored by this package's
+// directives, or globally.
+func (d *Directives) isIgnored(tn structer.TypeName) bool {
+	if _, ok := d.ignore[tn]; ok {
+		return true
+	}
+	if d.global != nil {
+		_, ok := d.global.ignore[tn]
+		return ok
+	}
+	return false
+}
+
 // find all comment lines that begin with //msgp:
 func loadDirectives(tpset *structer.TypePackageSet, pkg string) ([]Directive, error) {
 	var d []Directive
@@ -139,6 +251,7 @@ func loadDirectives(tpset *structer.TypePackageSet, pkg string) ([]Directive, er
 
 type DirectivesCache struct {
 	pkgDirectives map[string]*Directives
+	global        *Directives
 	tpset         *structer.TypePackageSet
 }
 
@@ -146,14 +259,40 @@ func NewDirectivesCache(tpset *structer.TypePackageSet) *DirectivesCache {
 	return &DirectivesCache{
 		tpset:         tpset,
 		pkgDirectives: make(map[string]*Directives),
+		global:        NewDirectives(tpset, ""),
 	}
 }
 
-func (d *DirectivesCache) Ignored(dctvs *Directives, fullName structer.TypeName) bool {
-	if _, ok := dctvs.ignore[fullName]; ok {
-		return true
+// AddGlobal adds shim or ignore directives that apply to every package, as if
+// they had been declared in each one. Types must be fully qualified.
+//
+// The using: functions of a global shim must be declared in the same package
+// as the shimmed type, and are given without a package name. They are
+// qualified with the package's import name in each package the shim is
+// copied into.
+func (d *DirectivesCache) AddGlobal(dirs ...Directive) error {
+	for _, dir := range dirs {
+		switch dir := dir.(type) {
+		case *ShimDirective:
+			tn, err := structer.ParseTypeName(dir.Type)
+			if err != nil || tn.PackagePath == "" {
+				return errors.Errorf("global shim type %q must include the full package path", dir.Type)
+			}
+			for _, fn := range []string{dir.ToFunc, dir.FromFunc} {
+				if !token.IsIdentifier(fn) {
+					return errors.Errorf("global shim function %q must be a plain function name declared in %s", fn, tn.PackagePath)
+				}
+			}
+		case *IgnoreDirective:
+		default:
+			return errors.Errorf("only shim and ignore directives can be global, found %+v", dir)
+		}
 	}
-	return false
+	return d.global.add(dirs...)
+}
+
+func (d *DirectivesCache) Ignored(dctvs *Directives, fullName structer.TypeName) bool {
+	return dctvs.isIgnored(fullName)
 }
 
 func (d *DirectivesCache) IgnoredPkg(fullName structer.TypeName) (bool, error) {
@@ -164,10 +303,7 @@ func (d *DirectivesCache) IgnoredPkg(fullName structer.TypeName) (bool, error) {
 	if dctvs == nil {
 		return false, nil
 	}
-	if _, ok := dctvs.ignore[fullName]; ok {
-		return true, nil
-	}
-	return false, nil
+	return dctvs.isIgnored(fullName), nil
 }
 
 func (d *DirectivesCache) Ensure(pkg string) (*Directives, error) {
@@ -176,6 +312,7 @@ func (d *DirectivesCache) Ensure(pkg string) (*Directives, error) {
 	var err error
 	if drctvs, ok = d.pkgDirectives[pkg]; !ok {
 		drctvs = NewDirectives(d.tpset, pkg)
+		drctvs.global = d.global
 		if err = drctvs.load(); err != nil {
 			return nil, err
 		}
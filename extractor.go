@@ -3,6 +3,8 @@ package msgpgen
 import (
 	"fmt"
 	"go/types"
+	"sort"
+	"strings"
 
 	"github.com/pkg/errors"
 	"github.com/shabbyrobe/structer"
@@ -15,8 +17,25 @@ type extractor struct {
 	dctvCache         *DirectivesCache
 	ifaces            ifaces
 	state             *State
+	ids               idAssigner
 	defaultAllowExtra bool
 
+	// whether msgp encodes unexported fields
+	unexported bool
+
+	// packages we are allowed to generate into
+	scope packageScope
+
+	// if set, a record of every decision is added to this
+	report *Report
+
+	// if set, every type and the references between them are added to this
+	graph *Graph
+
+	log Log
+
+	intercept interceptConfig
+
 	// temporary file output mapped by package name, to be joined by newlines.
 	tempOutput map[string][]string
 
@@ -24,23 +43,54 @@ type extractor struct {
 	// goes into the result AFTER msgp has been run.
 	extraOutput map[string][]string
 
+	// extra test output mapped by package name, appended to the generated
+	// tests in the same way.
+	extraTestOutput map[string][]string
+
 	// have we rendered this type to the temp output? this is different to
 	// the type queue's "seen" map as that includes the origin package too.
 	tempRendered map[string]bool
+
+	// structs that will be encoded as tuples once every interface has been
+	// found; implementers of interfaces with the flat layout stay maps.
+	tuples []autoTuple
+
+	// state entries moved by //msgp:formerly directives
+	renamed []StateRename
+
+	// imports needed by the temp output, mapped by package name to the
+	// import path and the name it is imported as. msgp copies these into
+	// the generated file.
+	tempImports map[string]map[string]string
+}
+
+type autoTuple struct {
+	tn   structer.TypeName
+	pkg  string
+	name string
 }
 
 func newExtractor(tpset *structer.TypePackageSet, dctvCache *DirectivesCache, typq *TypeQueue, state *State) *extractor {
 	return &extractor{
-		typq:         typq,
-		tpset:        tpset,
-		tvis:         newMsgpTypeVisitor(tpset, typq),
-		dctvCache:    dctvCache,
-		tempOutput:   make(map[string][]string),
-		extraOutput:  make(map[string][]string),
-		tempRendered: make(map[string]bool),
-		state:        state,
-		ifaces:       make(ifaces),
+		typq:            typq,
+		tpset:           tpset,
+		tvis:            newMsgpTypeVisitor(tpset, typq),
+		dctvCache:       dctvCache,
+		tempOutput:      make(map[string][]string),
+		extraOutput:     make(map[string][]string),
+		extraTestOutput: make(map[string][]string),
+		tempRendered:    make(map[string]bool),
+		tempImports:     make(map[string]map[string]string),
+		state:           state,
+		ifaces:          make(ifaces),
+	}
+}
+
+func (e *extractor) addImport(pkg, path, name string) {
+	if e.tempImports[pkg] == nil {
+		e.tempImports[pkg] = make(map[string]string)
 	}
+	e.tempImports[pkg][path] = name
 }
 
 func (e *extractor) extract() error {
@@ -54,7 +104,8 @@ func (e *extractor) extract() error {
 		if _, ok := primitives[tqi.Type.String()]; ok {
 			// FIXME: Though maybe for whatever reason you might be shimming a
 			// msgp primitive in a specific package?
-			fmt.Printf("%s->%s: SUPPORTED DIRECTLY\n", tqi.OriginPkg, tqi.Name)
+			wlog(e.log, LogDebug, LogExtract, LogGeneral, "%s->%s: SUPPORTED DIRECTLY", tqi.OriginPkg, tqi.Name)
+			e.record(tqi, DecisionSupported, "", "")
 			continue
 		}
 
@@ -103,26 +154,321 @@ func (e *extractor) extract() error {
 		}
 	}
 
+	cfgs := make(map[structer.TypeName]interceptConfig, len(e.ifaces))
+	flat := make(map[structer.TypeName]bool)
+	for _, iface := range e.ifaces {
+		cfg, err := e.interceptConfig(iface.name)
+		if err != nil {
+			return err
+		}
+		cfgs[iface.name] = cfg
+		if cfg.layout == EnvelopeFlat {
+			for _, tn := range iface.implementers() {
+				flat[tn] = true
+			}
+		}
+	}
+
+	// structs are tuples by default, but the flat layout adds the
+	// discriminator to the implementer's own map
+	for _, t := range e.tuples {
+		if flat[t.tn] {
+			continue
+		}
+		if err := e.dctvCache.pkgDirectives[t.pkg].add(&TupleDirective{Types: []string{t.name}}); err != nil {
+			return err
+		}
+	}
+
 	// build interface mappers
 	for _, iface := range e.ifaces {
+		cfg := cfgs[iface.name]
+		if cfg.layout == EnvelopeFlat {
+			if err := e.checkFlat(iface); err != nil {
+				return err
+			}
+		}
+		if cfg.unknown {
+			if err := e.genUnknown(iface, cfg); err != nil {
+				return err
+			}
+		}
+		if cfg.open {
+			if err := e.genOpen(iface, cfg); err != nil {
+				return err
+			}
+		}
+		if cfg.typeIDs {
+			if err := e.genRegistry(iface, cfg); err != nil {
+				return err
+			}
+		}
 		for _, inPkg := range iface.inPackages {
 			pkgDctvs, ok := e.dctvCache.pkgDirectives[inPkg]
 			if !ok {
 				return errors.Errorf("could not find directives for package %s", inPkg)
 			}
-			buf, interceptDctv, err := genIntercept(e.tpset, inPkg, pkgDctvs, e.state, iface)
+			buf, tests, interceptDctv, err := genIntercept(e.tpset, inPkg, pkgDctvs, e.ids, iface, cfg)
 			if err != nil {
 				return err
 			}
 			pkgDctvs.add(interceptDctv)
 
 			e.extraOutput[inPkg] = append(e.extraOutput[inPkg], buf.String())
+			e.extraTestOutput[inPkg] = append(e.extraTestOutput[inPkg], tests.String())
+		}
+	}
+
+	return nil
+}
+
+// interceptConfig returns the options for the interface's interceptors: the
+// defaults from the config, overridden by directives in the package that
+// declares the interface.
+func (e *extractor) interceptConfig(iface structer.TypeName) (interceptConfig, error) {
+	cfg := e.intercept
+	if e.tpset.Kinds[iface.PackagePath] != structer.UserPackage {
+		return cfg, nil
+	}
+	dctvs, err := e.dctvCache.Ensure(iface.PackagePath)
+	if err != nil {
+		return cfg, err
+	}
+	if d := dctvs.discriminator[iface]; d != nil {
+		cfg.discriminator = d.As
+		cfg.accept = d.Accept
+	}
+	if l, ok := dctvs.envelope[iface]; ok {
+		cfg.layout = l
+	}
+	cfg.open = dctvs.open[iface]
+	cfg.unknown = dctvs.unknown[iface]
+	return cfg, nil
+}
+
+// genUnknown generates the type that holds values of the interface with an
+// unknown ID into the package that declares the interface.
+func (e *extractor) genUnknown(iface *iface, cfg interceptConfig) error {
+	for _, d := range append([]Discriminator{cfg.discriminator}, cfg.accept...) {
+		if d == DiscriminatorName {
+			return errors.Errorf("%s keeps values with unknown IDs, which does not work with the name discriminator", iface.name)
+		}
+	}
+	buf, err := genUnknownType(iface)
+	if err != nil {
+		return err
+	}
+	pkg := iface.name.PackagePath
+	e.extraOutput[pkg] = append(e.extraOutput[pkg], buf.String())
+	return nil
+}
+
+// isUnknownHolder reports whether the type is the one generated by
+// genUnknown, which implements its interface but is never given an ID.
+func (e *extractor) isUnknownHolder(tn structer.TypeName) (bool, error) {
+	if !strings.HasPrefix(tn.Name, unknownPrefix) || e.tpset.Kinds[tn.PackagePath] != structer.UserPackage {
+		return false, nil
+	}
+	dctvs, err := e.dctvCache.Ensure(tn.PackagePath)
+	if err != nil {
+		return false, err
+	}
+	iface := structer.TypeName{PackagePath: tn.PackagePath, Name: strings.TrimPrefix(tn.Name, unknownPrefix)}
+	return dctvs.unknown[iface], nil
+}
+
+// genRegistry generates the ID registry for the interface into the package
+// that declares it.
+func (e *extractor) genRegistry(iface *iface, cfg interceptConfig) error {
+	pkg := iface.name.PackagePath
+	if e.tpset.Kinds[pkg] != structer.UserPackage {
+		return errors.Errorf("%s is not declared in a user package, so its ID registry cannot be generated", iface.name)
+	}
+	dctvs, err := e.dctvCache.Ensure(pkg)
+	if err != nil {
+		return err
+	}
+	tts, err := interceptTypes(e.tpset, pkg, dctvs, e.ids, iface, cfg)
+	if err != nil {
+		return err
+	}
+
+	// shims are declared by the packages that use the implementer, which
+	// may not include this one
+	for i := range tts {
+		if tts[i].Shim != nil {
+			continue
+		}
+		tn, err := structer.ParseTypeName(tts[i].TypeName)
+		if err != nil {
+			return err
+		}
+		for _, inPkg := range iface.inPackages {
+			inDctvs, err := e.dctvCache.Ensure(inPkg)
+			if err != nil {
+				return err
+			}
+			if shim := inDctvs.shimFor(tn); shim != nil {
+				tts[i].Shim = shim
+				break
+			}
+		}
+	}
+
+	buf, err := genRegistry(iface, tts)
+	if err != nil {
+		return err
+	}
+	e.extraOutput[pkg] = append(e.extraOutput[pkg], buf.String())
+	return nil
+}
+
+// genOpen generates the registry for an interface with an open registry into
+// the package that declares it, and registers the known implementers from
+// their own packages.
+func (e *extractor) genOpen(iface *iface, cfg interceptConfig) error {
+	if !iface.name.IsExported() {
+		return errors.Errorf("%s has an open registry, so it must be exported", iface.name)
+	}
+	if cfg.layout == EnvelopeFlat {
+		return errors.Errorf("%s has an open registry, which does not support the flat envelope layout", iface.name)
+	}
+	for _, d := range append([]Discriminator{cfg.discriminator}, cfg.accept...) {
+		if d == DiscriminatorName {
+			return errors.Errorf("%s has an open registry, which does not support the name discriminator", iface.name)
+		}
+	}
+
+	buf, err := genOpenRegistry(iface, cfg)
+	if err != nil {
+		return err
+	}
+	pkg := iface.name.PackagePath
+	e.extraOutput[pkg] = append(e.extraOutput[pkg], buf.String())
+
+	seen := make(map[string]bool)
+	for _, tn := range iface.implementers() {
+		pkg := tn.PackagePath
+		if seen[pkg] || e.tpset.Kinds[pkg] != structer.UserPackage {
+			continue
+		}
+		seen[pkg] = true
+
+		dctvs, err := e.dctvCache.Ensure(pkg)
+		if err != nil {
+			return err
+		}
+		buf, err := genOpenInit(e.tpset, pkg, dctvs, e.ids, iface, cfg)
+		if err != nil {
+			return err
 		}
+		if buf == nil {
+			continue
+		}
+
+		// the registrations are generated into the implementer's package,
+		// which must import the interface's package to call Register.
+		if !e.scope.allows(pkg) {
+			return errors.Errorf("%s has an open registry, but implementer package %s is outside the generation scope - "+
+				"add the package to -scope so its types can be registered", iface.name, pkg)
+		}
+		if pkg != iface.name.PackagePath {
+			if chain := importChain(e.tpset, iface.name.PackagePath, pkg); chain != nil {
+				return errors.Errorf("%s has an open registry, but registering the implementers in %s would create an import cycle: %s",
+					iface.name, pkg, strings.Join(append(chain, iface.name.PackagePath), " -> "))
+			}
+		}
+		e.extraOutput[pkg] = append(e.extraOutput[pkg], buf.String())
+	}
+	return nil
+}
+
+// importChain returns the packages on a path of imports from one package to
+// another, including both, or nil if from does not import to.
+func importChain(tpset *structer.TypePackageSet, from, to string) []string {
+	seen := make(map[string]bool)
+	var walk func(pkg string) []string
+	walk = func(pkg string) []string {
+		if pkg == to {
+			return []string{pkg}
+		}
+		if seen[pkg] {
+			return nil
+		}
+		seen[pkg] = true
+		tpkg := tpset.TypePackages[pkg]
+		if tpkg == nil {
+			return nil
+		}
+		for _, imp := range tpkg.Imports() {
+			if chain := walk(imp.Path()); chain != nil {
+				return append([]string{pkg}, chain...)
+			}
+		}
+		return nil
 	}
+	return walk(from)
+}
 
+// checkFlat ensures none of the interface's implementers has been made a
+// tuple with a //msgp:tuple directive or has a field encoded with the
+// discriminator's key, as the flat layout adds the discriminator to the
+// value's map. The automatic tuple is already left off.
+func (e *extractor) checkFlat(iface *iface) error {
+	for _, tn := range iface.implementers() {
+		if e.tpset.Kinds[tn.PackagePath] != structer.UserPackage {
+			continue
+		}
+		dctvs, err := e.dctvCache.Ensure(tn.PackagePath)
+		if err != nil {
+			return err
+		}
+		if _, ok := dctvs.tuple[tn]; ok {
+			return errors.Errorf("%s implements %s, which uses the flat envelope layout, so it cannot be a //msgp:tuple",
+				tn, iface.name)
+		}
+		if dctvs.shimFor(tn) != nil {
+			continue
+		}
+		obj := e.tpset.FindObject(tn)
+		if obj == nil {
+			continue
+		}
+		if s, ok := obj.Type().Underlying().(*types.Struct); ok {
+			if field := flatKeyField(s, e.unexported); field != "" {
+				return errors.Errorf("%s implements %s, which uses the flat envelope layout, so its field %s cannot be encoded as %q",
+					tn, iface.name, field, flatKey)
+			}
+		}
+	}
 	return nil
 }
 
+// flatKey is the map key the flat envelope layout writes the discriminator to.
+const flatKey = "t"
+
+// flatKeyField returns the name of the struct's field that msgp encodes with
+// the key used for the flat layout's discriminator, or "" if there is none.
+func flatKeyField(s *types.Struct, unexported bool) string {
+	for i := 0; i < s.NumFields(); i++ {
+		field := s.Field(i)
+		if !field.Exported() && !unexported {
+			continue
+		}
+		key := ParseTag(s.Tag(i)).Name
+		if key == "-" {
+			continue
+		}
+		if key == "" {
+			key = field.Name()
+		}
+		if key == flatKey {
+			return field.Name()
+		}
+	}
+	return ""
+}
+
 func (e *extractor) extractNamedStruct(tqi *TypeQueueItem, pkg string, ft *types.Named, s *types.Struct) error {
 	// type is a named struct. we need to walk all types nested in
 	// this declaration and queue them for processing, and we also
@@ -132,6 +478,7 @@ func (e *extractor) extractNamedStruct(tqi *TypeQueueItem, pkg string, ft *types
 	if !e.tempRendered[tqi.Name] {
 		e.tempRendered[tqi.Name] = true
 	} else {
+		e.record(tqi, DecisionSeen, "", "")
 		return nil
 	}
 
@@ -153,8 +500,27 @@ func (e *extractor) extractNamedStruct(tqi *TypeQueueItem, pkg string, ft *types
 	// the package that uses the type is responsible for declaring //msgp:shim,
 	// not the package that declares it, so we need to look at the referring
 	// package's directives, not the declaration's.
-	if _, ok := originDctvs.shim[tn]; ok {
-		fmt.Printf("%s: ALREADY SHIMMED\n", tqi.Name)
+	if shim := originDctvs.shimFor(tn); shim != nil {
+		// global shims have to be emitted into each package that uses them,
+		// with their functions qualified by the shimmed type's package.
+		if _, ok := originDctvs.shim[tn]; !ok {
+			local := *shim
+			for _, fn := range []*string{&local.ToFunc, &local.FromFunc} {
+				ln, err := e.tpset.LocalImportName(structer.TypeName{PackagePath: tn.PackagePath, Name: *fn}, tqi.OriginPkg)
+				if err != nil {
+					return errors.Wrapf(err, "msgpgen: could not qualify shim function %s for %s", *fn, tqi.OriginPkg)
+				}
+				if idx := strings.LastIndex(ln, "."); idx >= 0 {
+					e.addImport(tqi.OriginPkg, tn.PackagePath, ln[:idx])
+				}
+				*fn = ln
+			}
+			if err := originDctvs.add(&local); err != nil {
+				return err
+			}
+		}
+		wlog(e.log, LogDebug, LogDirective, LogGeneral, "%s: ALREADY SHIMMED", tqi.Name)
+		e.record(tqi, DecisionShimmed, shim.String(), "")
 		return nil
 	}
 
@@ -162,7 +528,18 @@ func (e *extractor) extractNamedStruct(tqi *TypeQueueItem, pkg string, ft *types
 	// not the package that refers to it, so we need to look at the package's directives,
 	// not the origin's.
 	if e.dctvCache.Ignored(pkgDctvs, tn) {
-		fmt.Printf("%s: IGNORING\n", tqi.Name)
+		wlog(e.log, LogDebug, LogDirective, LogGeneral, "%s: IGNORING", tqi.Name)
+		e.record(tqi, DecisionIgnored, "//msgp:ignore "+tn.String(), "")
+		return nil
+	}
+
+	// values of unknown IDs are generated along with the interceptors and
+	// encode themselves
+	if ok, err := e.isUnknownHolder(tn); err != nil {
+		return err
+	} else if ok {
+		wlog(e.log, LogDebug, LogExtract, LogGeneral, "%s: UNKNOWN HOLDER", tqi.Name)
+		e.record(tqi, DecisionIgnored, "", "")
 		return nil
 	}
 
@@ -178,19 +555,24 @@ func (e *extractor) extractNamedStruct(tqi *TypeQueueItem, pkg string, ft *types
 			tqi.OriginPkg, ft.String(), kind)
 	}
 
+	if err := e.checkScope(tqi, pkg, ft); err != nil {
+		return err
+	}
+
 	// walk structs looking for new types to queue
 	if err := e.tvis.walk(tn, ft.Underlying(), tqi); err != nil {
 		return err
 	}
 
 	// build the output {{{
-	fmt.Printf("%s: EXTRACTING\n", tqi.Name)
+	wlog(e.log, LogDebug, LogExtract, LogGeneral, "%s: EXTRACTING", tqi.Name)
+	e.record(tqi, DecisionExtracted, "", pkg)
 	contents, err := e.tpset.ExtractSource(tn)
 	if err != nil {
 		return err
 	}
 
-	pkgDctvs.add(&TupleDirective{Types: []string{findImportedName(tqi.Name, pkg)}})
+	e.tuples = append(e.tuples, autoTuple{tn: tn, pkg: pkg, name: findImportedName(tqi.Name, pkg)})
 	if e.defaultAllowExtra {
 		pkgDctvs.add(&AllowExtraDirective{Types: []string{findImportedName(tqi.Name, pkg)}})
 	}
@@ -205,6 +587,7 @@ func (e *extractor) extractNamedCompound(tqi *TypeQueueItem, pkg string, ft *typ
 	if !e.tempRendered[tqi.Name] {
 		e.tempRendered[tqi.Name] = true
 	} else {
+		e.record(tqi, DecisionSeen, "", "")
 		return nil
 	}
 
@@ -222,7 +605,8 @@ func (e *extractor) extractNamedCompound(tqi *TypeQueueItem, pkg string, ft *typ
 	// not the package that refers to it, so we need to look at the package's directives,
 	// not the origin's.
 	if e.dctvCache.Ignored(pkgDctvs, tn) {
-		fmt.Printf("%s: IGNORING\n", tqi.Name)
+		wlog(e.log, LogDebug, LogDirective, LogGeneral, "%s: IGNORING", tqi.Name)
+		e.record(tqi, DecisionIgnored, "//msgp:ignore "+tn.String(), "")
 		return nil
 	}
 
@@ -238,8 +622,13 @@ func (e *extractor) extractNamedCompound(tqi *TypeQueueItem, pkg string, ft *typ
 			tqi.OriginPkg, ft.String(), kind)
 	}
 
+	if err := e.checkScope(tqi, pkg, ft); err != nil {
+		return err
+	}
+
 	{ // build the output
-		fmt.Printf("%s: EXTRACTING\n", tqi.Name)
+		wlog(e.log, LogDebug, LogExtract, LogGeneral, "%s: EXTRACTING", tqi.Name)
+		e.record(tqi, DecisionExtracted, "", pkg)
 		contents, err := e.tpset.ExtractSource(tn)
 		if err != nil {
 			return err
@@ -259,10 +648,11 @@ func (e *extractor) extractShimmedSupported(tqi *TypeQueueItem, pkg string, ft *
 	if !e.tempRendered[originRenderKey] {
 		e.tempRendered[originRenderKey] = true
 	} else {
+		e.record(tqi, DecisionSeen, "", "")
 		return nil
 	}
 
-	fmt.Printf("%s: SHIMMING INTO %s\n", tqi.Name, tqi.OriginPkg)
+	wlog(e.log, LogDebug, LogDirective, LogGeneral, "%s: SHIMMING INTO %s", tqi.Name, tqi.OriginPkg)
 
 	importedName := findImportedName(ft.String(), tqi.OriginPkg)
 
@@ -274,6 +664,8 @@ func (e *extractor) extractShimmedSupported(tqi *TypeQueueItem, pkg string, ft *
 		Mode:     Cast,
 	}
 
+	e.record(tqi, DecisionAutoShim, shimDctv.String(), tqi.OriginPkg)
+
 	dctvs, err := e.dctvCache.Ensure(tqi.OriginPkg)
 	if err != nil {
 		return err
@@ -308,8 +700,8 @@ func (e *extractor) extractShimmedSupported(tqi *TypeQueueItem, pkg string, ft *
 func (e *extractor) extractInterface(tqi *TypeQueueItem, pkg string, typ types.Type) error {
 	// FIXME: bail if we encounter interface{}
 
-	if e.state == nil {
-		return errors.Errorf("tried to extract interface %s without a state file", typ)
+	if e.ids == nil {
+		return errors.Errorf("tried to extract interface %s without a state file; pass -state, or -ids hash to derive IDs from type names", typ)
 	}
 
 	tn, err := structer.ParseTypeName(typ.String())
@@ -317,6 +709,10 @@ func (e *extractor) extractInterface(tqi *TypeQueueItem, pkg string, typ types.T
 		return errors.Wrapf(err, "msgpgen: could not extract interface from %s", tqi.Name)
 	}
 
+	if err := e.checkScope(tqi, pkg, typ); err != nil {
+		return err
+	}
+
 	// Find the types that implement the interface and add them to the type queue for
 	// walking, but only if we have not already done so for this interface
 	if e.ifaces[tn] == nil {
@@ -326,9 +722,20 @@ func (e *extractor) extractInterface(tqi *TypeQueueItem, pkg string, typ types.T
 		if err != nil {
 			return err
 		}
+		for ctn := range ts {
+			if ok, err := e.isUnknownHolder(ctn); err != nil {
+				return err
+			} else if ok {
+				delete(ts, ctn)
+			}
+		}
 
 		e.ifaces[tn].types = ts
 
+		if err := e.checkPins(tn, ts); err != nil {
+			return err
+		}
+
 		for _, ctn := range ts.SortedKeys() {
 			if !ctn.IsExported() {
 				continue
@@ -342,8 +749,8 @@ func (e *extractor) extractInterface(tqi *TypeQueueItem, pkg string, typ types.T
 				continue
 			}
 
-			// Every interface type needs a stable ID in the state file
-			if _, err := e.state.EnsureType(ctn); err != nil {
+			// Every interface type needs a stable ID.
+			if err := e.ensureID(ctn, tn); err != nil {
 				return err
 			}
 
@@ -354,6 +761,9 @@ func (e *extractor) extractInterface(tqi *TypeQueueItem, pkg string, typ types.T
 				elem = p.Elem()
 			}
 			e.typq.AddType(tqi.OriginPkg, ctn.String(), elem).SetParents(tqi.Parents.Next(tn))
+			if e.graph != nil {
+				e.graph.addEdge(tn.String(), ctn.String(), "implements")
+			}
 		}
 	}
 
@@ -362,7 +772,8 @@ func (e *extractor) extractInterface(tqi *TypeQueueItem, pkg string, typ types.T
 	e.ifaces[tn].addPackage(tqi.OriginPkg)
 
 	{ // build the output
-		fmt.Printf("%s: EXTRACTING\n", tqi.Name)
+		wlog(e.log, LogDebug, LogExtract, LogGeneral, "%s: EXTRACTING", tqi.Name)
+		e.record(tqi, DecisionInterface, interceptDirective(tn), pkg)
 		contents, err := e.tpset.ExtractSource(tn)
 		if err != nil {
 			return err
@@ -373,6 +784,101 @@ func (e *extractor) extractInterface(tqi *TypeQueueItem, pkg string, typ types.T
 	return nil
 }
 
+// checkScope returns an error if the type declared in pkg would need to have
+// code generated into a package outside the configured scope.
+func (e *extractor) checkScope(tqi *TypeQueueItem, pkg string, typ types.Type) error {
+	if e.scope.allows(pkg) {
+		return nil
+	}
+	return errors.Errorf("%s: type '%s' in package %s is outside the generation scope - add the package to -scope, "+
+		"add a //msgp:shim directive for the type to %s, or ignore it with a global \"ignore %s\" directive in the project file\n  via: %s",
+		tqi.OriginPkg, typ, pkg, tqi.OriginPkg, typ, tqi.Path())
+}
+
+// ensureID gives the type an ID as an implementer of iface.
+//
+// The type's declaring package is checked for directives first: if the type
+// has no ID in the state yet but one of the names in a //msgp:formerly
+// directive does, that entry is moved to the new name so the type keeps its
+// ID. If a //msgp:typeid directive pins the type's ID, the assigned ID must
+// agree with it.
+func (e *extractor) ensureID(tn, iface structer.TypeName) error {
+	pin := 0
+	if e.tpset.Kinds[tn.PackagePath] == structer.UserPackage {
+		dctvs, err := e.dctvCache.Ensure(tn.PackagePath)
+		if err != nil {
+			return err
+		}
+		if e.state != nil {
+			if err := e.applyRenames(iface, dctvs, tn); err != nil {
+				return err
+			}
+		}
+		pin = dctvs.typeid[tn]
+	}
+
+	_, err := e.ids.assignID(tn, iface, pin)
+	return err
+}
+
+// checkPins ensures no two implementers of the interface have the same ID
+// pinned by //msgp:typeid directives. Pins in one package are checked when
+// the directives are loaded, but the implementers may be spread across
+// several.
+func (e *extractor) checkPins(iface structer.TypeName, ts structer.TypeMap) error {
+	pinned := make(map[int]structer.TypeName)
+	for _, tn := range ts.SortedKeys() {
+		if e.tpset.Kinds[tn.PackagePath] != structer.UserPackage {
+			continue
+		}
+		dctvs, err := e.dctvCache.Ensure(tn.PackagePath)
+		if err != nil {
+			return err
+		}
+		id := dctvs.typeid[tn]
+		if id == 0 {
+			continue
+		}
+		if other, ok := pinned[id]; ok {
+			return errors.Errorf("typeid %d is pinned to both %s in package %s and %s in package %s, which both implement %s",
+				id, other.Name, other.PackagePath, tn.Name, tn.PackagePath, iface)
+		}
+		pinned[id] = tn
+	}
+	return nil
+}
+
+func (e *extractor) applyRenames(iface structer.TypeName, dctvs *Directives, tn structer.TypeName) error {
+	space := e.state.Space(iface)
+	if _, ok := space.Types[tn]; ok {
+		return nil
+	}
+	for _, former := range dctvs.formerly[tn] {
+		if _, ok := space.Types[former]; !ok {
+			continue
+		}
+		if err := space.Rename(former, tn); err != nil {
+			return err
+		}
+		if !e.state.Namespaced {
+			iface = structer.TypeName{}
+		}
+		e.renamed = append(e.renamed, StateRename{Iface: iface, From: former, To: tn})
+		wlog(e.log, LogInfo, LogDirective, LogGeneral, "%s: renamed from %s in state, keeping its ID", tn, former)
+		return nil
+	}
+	return nil
+}
+
+func (e *extractor) record(tqi *TypeQueueItem, decision Decision, directive string, pkg string) {
+	if e.report != nil {
+		e.report.add(tqi, decision, directive, pkg)
+	}
+	if e.graph != nil {
+		e.graph.decide(tqi.Name, decision)
+	}
+}
+
 func (e *extractor) isIntercepted(origin string, tn structer.TypeName) bool {
 	if e.tpset.Kinds[origin] == structer.UserPackage {
 		originDctvs, err := e.dctvCache.Ensure(origin)
@@ -401,6 +907,19 @@ func newIface(tn structer.TypeName) *iface {
 	}
 }
 
+// implementers returns the names of the types that implement the interface,
+// sorted.
+func (i *iface) implementers() []structer.TypeName {
+	names := make([]structer.TypeName, 0, len(i.types))
+	for tn := range i.types {
+		names = append(names, tn)
+	}
+	sort.Slice(names, func(a, b int) bool {
+		return names[a].String() < names[b].String()
+	})
+	return names
+}
+
 func (i *iface) addPackage(pkg string) {
 	i.inPackages = append(i.inPackages, pkg)
 }
@@ -0,0 +1,113 @@
+package msgpgen
+
+import (
+	"go/types"
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/shabbyrobe/structer"
+)
+
+func TestImportChain(t *testing.T) {
+	// iface imports mid, which imports impl; other imports iface
+	pkgs := make(map[string]*types.Package)
+	for _, path := range []string{"p/iface", "p/mid", "p/impl", "p/other"} {
+		pkgs[path] = types.NewPackage(path, path[2:])
+	}
+	pkgs["p/iface"].SetImports([]*types.Package{pkgs["p/mid"]})
+	pkgs["p/mid"].SetImports([]*types.Package{pkgs["p/impl"], pkgs["p/iface"]})
+	pkgs["p/other"].SetImports([]*types.Package{pkgs["p/iface"]})
+	tpset := &structer.TypePackageSet{TypePackages: pkgs}
+
+	for _, tc := range []struct {
+		from, to string
+		chain    []string
+	}{
+		{"p/iface", "p/impl", []string{"p/iface", "p/mid", "p/impl"}},
+		{"p/iface", "p/other", nil},
+		{"p/impl", "p/iface", nil},
+		{"p/other", "p/impl", []string{"p/other", "p/iface", "p/mid", "p/impl"}},
+		{"p/missing", "p/impl", nil},
+	} {
+		if chain := importChain(tpset, tc.from, tc.to); !reflect.DeepEqual(chain, tc.chain) {
+			t.Errorf("%s to %s: %q != %q", tc.from, tc.to, chain, tc.chain)
+		}
+	}
+}
+
+func TestFlatKeyField(t *testing.T) {
+	str := types.Typ[types.String]
+	field := func(name string) *types.Var {
+		return types.NewField(0, nil, name, str, false)
+	}
+	for _, tc := range []struct {
+		name       string
+		fields     []*types.Var
+		tags       []string
+		unexported bool
+		found      string
+	}{
+		{"none", []*types.Var{field("Name"), field("T")}, nil, false, ""},
+		{"name", []*types.Var{field("Name"), field("t")}, nil, true, "t"},
+		{"unexported", []*types.Var{field("t")}, nil, false, ""},
+		{"tag", []*types.Var{field("Name"), field("Kind")}, []string{"", `msg:"t,omitempty"`}, false, "Kind"},
+		{"renamed", []*types.Var{field("t")}, []string{`msg:"kind"`}, true, ""},
+		{"skipped", []*types.Var{field("T")}, []string{`msg:"-"`}, false, ""},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			s := types.NewStruct(tc.fields, tc.tags)
+			if found := flatKeyField(s, tc.unexported); found != tc.found {
+				t.Fatalf("%q != %q", found, tc.found)
+			}
+		})
+	}
+}
+
+func TestCheckPins(t *testing.T) {
+	iface := structer.TypeName{PackagePath: "p/iface", Name: "Msg"}
+	a := structer.TypeName{PackagePath: "p/a", Name: "Created"}
+	b := structer.TypeName{PackagePath: "p/b", Name: "Deleted"}
+	c := structer.TypeName{PackagePath: "p/b", Name: "Updated"}
+
+	for _, tc := range []struct {
+		name string
+		pins map[structer.TypeName]int
+		err  string
+	}{
+		{"none", nil, ""},
+		{"unique", map[structer.TypeName]int{a: 1, b: 2, c: 3}, ""},
+		{"same-package", map[structer.TypeName]int{b: 2, c: 2}, "typeid 2"},
+		{"across-packages", map[structer.TypeName]int{a: 5, c: 5},
+			"typeid 5 is pinned to both Created in package p/a and Updated in package p/b, which both implement p/iface.Msg"},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			tpset := &structer.TypePackageSet{Kinds: map[string]structer.PackageKind{
+				"p/a": structer.UserPackage,
+				"p/b": structer.UserPackage,
+			}}
+			dctvCache := NewDirectivesCache(tpset)
+			for _, pkg := range []string{"p/a", "p/b"} {
+				dctvs := NewDirectives(tpset, pkg)
+				for tn, id := range tc.pins {
+					// the same-package case is caught by the directives
+					// themselves, so it is set directly here
+					if tn.PackagePath == pkg {
+						dctvs.typeid[tn] = id
+					}
+				}
+				dctvCache.pkgDirectives[pkg] = dctvs
+			}
+
+			e := newExtractor(tpset, dctvCache, nil, nil)
+			err := e.checkPins(iface, structer.TypeMap{a: nil, b: nil, c: nil})
+			if tc.err == "" {
+				if err != nil {
+					t.Fatal(err)
+				}
+			} else if err == nil || !strings.Contains(err.Error(), tc.err) {
+				t.Fatalf("expected error containing %q, found %v", tc.err, err)
+			}
+		})
+	}
+}
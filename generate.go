@@ -32,6 +32,53 @@ type Config struct {
 	KeepTemp            bool
 	AllowExtra          bool
 
+	// Generate a registry of the IDs of each intercepted interface's
+	// implementers in the package that declares the interface: ID constants,
+	// a function to look up a value's ID, a function to create a value by ID,
+	// and a sorted list of the IDs.
+	GenTypeIDs bool
+
+	// How implementers of intercepted interfaces are given their IDs. The
+	// hash strategy doesn't use the state, so pass a nil state with it.
+	IDStrategy IDStrategy
+
+	// Default encoding of the discriminator written before each value of an
+	// intercepted interface. The //msgp:discriminator directive overrides it
+	// for a single interface.
+	Discriminator Discriminator
+
+	// Default layout used to write the discriminator and the value of an
+	// intercepted interface. The //msgp:envelope directive overrides it for
+	// a single interface.
+	Envelope Envelope
+
+	// Receives progress and diagnostic messages. If nil, nothing is logged.
+	Log Log
+
+	// If Check is set, Generate runs the full pipeline but leaves the
+	// destination files alone. If any of them differ from what would be
+	// generated, a *StaleError listing them is returned. Diff adds a unified
+	// diff of each stale file to the error.
+	Check bool
+	Diff  bool
+
+	// If set, a record of every extraction decision is appended to the report.
+	Report *Report
+
+	// If set, the types discovered and the references between them are added
+	// to the graph. Use NewGraph to create it.
+	Graph *Graph
+
+	// If set, Generate fails with a *StateProblemsError if the state has
+	// entries for types that no longer exist or no longer implement an
+	// intercepted interface, or if an implementer has no ID yet.
+	StrictState bool
+
+	// Import path patterns of the packages that may receive generated output.
+	// Patterns may contain "..." wildcards. If empty, any user package may be
+	// written to.
+	Scope []string
+
 	valid bool
 }
 
@@ -48,37 +95,161 @@ func NewConfig() Config {
 		FileTemplate:        "{pkg}_msgp_gen.go",
 		VersionFileTemplate: "msgpver",
 		TestTemplate:        "{pkg}_msgp_gen_test.go",
+		IDStrategy:          IDStrategyState,
+		Discriminator:       DiscriminatorString,
+		Envelope:            EnvelopeArray,
 		valid:               true,
 	}
 }
 
-func Generate(tpset *structer.TypePackageSet, state *State, dctvCache *DirectivesCache, config Config) (err error) {
+// Extraction is the result of walking the types in Config.Types without
+// generating any code.
+type Extraction struct {
+	// The implementers found for each interface that will be intercepted.
+	Interfaces map[structer.TypeName][]structer.TypeName
+
+	// Packages that would receive generated output, sorted.
+	Packages []string
+
+	// State entries that were moved to a type's new name by a
+	// //msgp:formerly directive, in the order they were moved.
+	Renamed []StateRename
+}
+
+// StateRename is a state entry that was moved from one type name to another,
+// keeping its ID.
+type StateRename struct {
+	// The interface whose ID space the entry was moved in. Empty for the
+	// global space.
+	Iface structer.TypeName
+
+	From, To structer.TypeName
+}
+
+// Extract walks the types in Config.Types exactly as Generate would, but
+// stops before running msgp or writing any files. Pass a Report in the config
+// to find out what was decided for each type.
+//
+// The state is updated with IDs for any new interface implementers; it is up
+// to the caller whether to save it.
+func Extract(tpset *structer.TypePackageSet, state *State, dctvCache *DirectivesCache, config Config) (*Extraction, error) {
+	ex, _, err := runExtractor(tpset, state, dctvCache, config)
+	if err != nil {
+		return nil, err
+	}
+	return ex.extraction(), nil
+}
+
+func (ex *extractor) extraction() *Extraction {
+	extn := &Extraction{
+		Interfaces: make(map[structer.TypeName][]structer.TypeName, len(ex.ifaces)),
+	}
+	for tn, iface := range ex.ifaces {
+		extn.Interfaces[tn] = iface.implementers()
+	}
+
+	seen := make(map[string]bool)
+	for pkg := range ex.tempOutput {
+		seen[pkg] = true
+	}
+	for pkg := range ex.extraOutput {
+		seen[pkg] = true
+	}
+	for pkg := range seen {
+		extn.Packages = append(extn.Packages, pkg)
+	}
+	sort.Strings(extn.Packages)
+	extn.Renamed = ex.renamed
+
+	return extn
+}
+
+func runExtractor(tpset *structer.TypePackageSet, state *State, dctvCache *DirectivesCache, config Config) (*extractor, *TypeQueue, error) {
 	if !config.valid {
-		return errors.New("please create config using NewConfig(), not Config{}")
+		return nil, nil, errors.New("please create config using NewConfig(), not Config{}")
 	}
 	var typq = NewTypeQueue(tpset)
 
 	for _, t := range config.Types {
-		if _, err = tpset.Import(t.PackagePath); err != nil {
-			fmt.Println("import failed:", t.PackagePath)
+		if _, err := tpset.Import(t.PackagePath); err != nil {
+			wlog(config.Log, LogWarn, LogTypeSet, LogGeneral, "import failed: %s", t.PackagePath)
 		}
 
 		typ := tpset.Objects[t]
 		if typ == nil {
-			return errors.Errorf("could not find type %s", t)
+			return nil, nil, errors.Errorf("could not find type %s", t)
 		}
 		typq.AddObj(t.PackagePath, typ)
 	}
 
 	ex := newExtractor(tpset, dctvCache, typq, state)
+	switch config.IDStrategy {
+	case "", IDStrategyState:
+		if state != nil {
+			ex.ids = state
+		}
+	case IDStrategyHash:
+		if state != nil {
+			return nil, nil, errors.Errorf("the hash ID strategy does not use a state file")
+		}
+		ex.ids = newHashIDs()
+	default:
+		return nil, nil, errors.Errorf("unknown ID strategy %q", config.IDStrategy)
+	}
+	ex.unexported = config.Unexported
 	if config.AllowExtra {
 		ex.defaultAllowExtra = config.AllowExtra
 	}
+	ex.scope = newPackageScope(config.Scope)
+	ex.report = config.Report
+	ex.graph = config.Graph
+	ex.tvis.graph = config.Graph
+	ex.log = config.Log
+	ex.intercept.typeIDs = config.GenTypeIDs
+	ex.intercept.layout = config.Envelope
+	if ex.intercept.layout == "" {
+		ex.intercept.layout = EnvelopeArray
+	} else if !ex.intercept.layout.valid() {
+		return nil, nil, errors.Errorf("unknown envelope layout %q", config.Envelope)
+	}
+	ex.intercept.discriminator = config.Discriminator
+	if ex.intercept.discriminator == "" {
+		ex.intercept.discriminator = DiscriminatorString
+	} else if !ex.intercept.discriminator.valid() {
+		return nil, nil, errors.Errorf("unknown discriminator encoding %q", config.Discriminator)
+	}
+	ex.tvis.log = config.Log
+
+	if err := ex.extract(); err != nil {
+		return nil, nil, err
+	}
+	if config.Report != nil {
+		config.Report.resolveFiles(tpset, config)
+	}
+	return ex, typq, nil
+}
 
-	if err = ex.extract(); err != nil {
+func Generate(tpset *structer.TypePackageSet, state *State, dctvCache *DirectivesCache, config Config) (err error) {
+	// The extractor gives new implementers IDs, so keep a copy of the state
+	// as loaded to find the ones that had none.
+	var loaded *State
+	if config.StrictState && state != nil {
+		if loaded, err = state.Clone(); err != nil {
+			return err
+		}
+	}
+
+	ex, typq, err := runExtractor(tpset, state, dctvCache, config)
+	if err != nil {
 		return err
 	}
 
+	if loaded != nil {
+		if problems := ValidateState(tpset, loaded, ex.extraction()); len(problems) > 0 {
+			return &StateProblemsError{Problems: problems}
+		}
+	}
+
 	// map of temp files to destination
 	var files = make(map[string]string)
 
@@ -87,11 +258,18 @@ func Generate(tpset *structer.TypePackageSet, state *State, dctvCache *Directive
 		defer cleanup.Cleanup(&err)
 	}
 
-	// need to ensure sorted order when iterating over temp output
+	// need to ensure sorted order when iterating over temp output. packages
+	// with only extra output, such as the registry in the package that
+	// declares an interface, still need a file.
 	var tempKeys []string
 	for opkg := range ex.tempOutput {
 		tempKeys = append(tempKeys, opkg)
 	}
+	for opkg := range ex.extraOutput {
+		if _, ok := ex.tempOutput[opkg]; !ok {
+			tempKeys = append(tempKeys, opkg)
+		}
+	}
 	sort.Strings(tempKeys)
 
 	for _, opkg := range tempKeys {
@@ -119,16 +297,32 @@ func Generate(tpset *structer.TypePackageSet, state *State, dctvCache *Directive
 		}
 
 		{ // generate temp file of joined definitions
-			fmt.Printf("\n======= %s %s\n", opkg, tempFileName)
+			wlog(config.Log, LogInfo, LogMsgp, LogGeneral, "generating %s in %s", opkg, tempFileName)
 
 			fmt.Fprintf(tf, "// +build ignore\n\n")
 			fmt.Fprintf(tf, "package %s\n\n", lpkg)
 
+			var importPaths []string
+			for path := range ex.tempImports[opkg] {
+				importPaths = append(importPaths, path)
+			}
+			sort.Strings(importPaths)
+			for _, path := range importPaths {
+				fmt.Fprintf(tf, "import %s %q\n", ex.tempImports[opkg][path], path)
+			}
+			if len(importPaths) > 0 {
+				fmt.Fprintln(tf)
+			}
+
 			for _, d := range dctv.directives {
 				dout, err := d.Build(tpset, opkg)
 				if err != nil {
 					return err
 				}
+				if dout == "" {
+					// not a msgp directive
+					continue
+				}
 				outputParts = append(outputParts, dout)
 			}
 
@@ -178,7 +372,6 @@ func Generate(tpset *structer.TypePackageSet, state *State, dctvCache *Directive
 				ttnb := lpkg + "_msgp_gen_test.go"
 				ttnd := strings.Replace(config.TestTemplate, "{pkg}", lpkg, -1)
 				ttn := filepath.Join(pkgPath, ttnd)
-				cleanup.Push(ttn)
 				files[filepath.Join(tempDir, ttnb)] = ttn
 			}
 			files[filepath.Join(tempDir, tgnb)] = filepath.Join(pkgPath, tgnb)
@@ -203,6 +396,7 @@ func Generate(tpset *structer.TypePackageSet, state *State, dctvCache *Directive
 			// https://github.com/tinylib/msgp/issues/183
 			scanner := bufio.NewScanner(&stdout)
 			for scanner.Scan() {
+				wlog(config.Log, LogDebug, LogMsgp, LogGeneral, "%s", scanner.Text())
 				if err = checkMsgpOutput(tpset, dctv, seen, scanner.Text()); err != nil {
 					return err
 				}
@@ -213,35 +407,27 @@ func Generate(tpset *structer.TypePackageSet, state *State, dctvCache *Directive
 
 			// append any extra generated stuff to the generated output (interceptions)
 			if extra, ok := ex.extraOutput[opkg]; ok {
-				f, err := os.OpenFile(tgn, os.O_APPEND|os.O_WRONLY, 0600)
-				if err != nil {
-					panic(err)
-				}
-				func() {
-					defer func() {
-						if cerr := f.Close(); cerr != nil {
-							panic(cerr)
-						}
-					}()
-					sortOutput(extra)
-					for _, e := range extra {
-						if _, err = f.WriteString(e); err != nil {
-							panic(err)
-						}
+				if _, err := os.Stat(tgn); os.IsNotExist(err) {
+					// msgp only writes a file if it generated any types
+					hdr := fmt.Sprintf("// Code generated by msgpgen. DO NOT EDIT.\n\npackage %s\n", lpkg)
+					if err := ioutil.WriteFile(tgn, []byte(hdr), 0600); err != nil {
+						return err
 					}
-				}()
-
-				src, err := ioutil.ReadFile(tgn)
-				if err != nil {
-					return err
 				}
-				// imports is supposed to be able to load data from a file, but that doesn't
-				// seem to work so we have to get the src ourselves.
-				p, err := imports.Process(tgn, src, nil)
-				if err != nil {
+				if err := appendOutput(tgn, extra); err != nil {
 					return err
 				}
-				if err := ioutil.WriteFile(tgn, p, 0600); err != nil {
+			}
+			if extra, ok := ex.extraTestOutput[opkg]; ok && config.GenTests {
+				ttn := filepath.Join(tempDir, lpkg+"_msgp_gen_test.go")
+				if _, err := os.Stat(ttn); os.IsNotExist(err) {
+					// msgp only writes tests if it generated any types
+					hdr := fmt.Sprintf("// Code generated by msgpgen. DO NOT EDIT.\n\npackage %s\n", lpkg)
+					if err := ioutil.WriteFile(ttn, []byte(hdr), 0600); err != nil {
+						return err
+					}
+				}
+				if err := appendOutput(ttn, extra); err != nil {
 					return err
 				}
 			}
@@ -249,13 +435,23 @@ func Generate(tpset *structer.TypePackageSet, state *State, dctvCache *Directive
 	}
 
 	// move the generated file into place, but only if the contents are different
-	// and only if it contains more than the preamble
-	for src, dest := range files {
+	// and only if it contains more than the preamble. In check mode nothing is
+	// moved; the differences are collected and returned as a *StaleError.
+	var srcs []string
+	for src := range files {
+		srcs = append(srcs, src)
+	}
+	sort.Slice(srcs, func(i, j int) bool { return files[srcs[i]] < files[srcs[j]] })
+
+	var stale StaleError
+	for _, src := range srcs {
+		dest := files[src]
 		write := false
 		destb, err := ioutil.ReadFile(dest)
 		if err != nil && !os.IsNotExist(err) {
 			return err
 		}
+		destMissing := os.IsNotExist(err)
 
 		// FIXME: this quickie hack won't consider the file as useful if it doesn't
 		// contain a function. this is to stop the situation where interfaces get
@@ -269,28 +465,46 @@ func Generate(tpset *structer.TypePackageSet, state *State, dctvCache *Directive
 		//     continue
 		// }
 
+		srcb, err := ioutil.ReadFile(src)
 		if os.IsNotExist(err) {
+			// msgp only writes its files if it generated something
+			continue
+		} else if err != nil {
+			return err
+		}
+		if destMissing {
 			write = true
 		} else {
-			srcb, err := ioutil.ReadFile(src)
-			if err != nil {
-				return err
-			}
 			write = bytes.Compare(srcb, destb) != 0
 		}
 
-		if write {
+		if config.Check {
+			if write {
+				sf := StaleFile{Path: dest}
+				if config.Diff {
+					if sf.Diff, err = unifiedDiff(dest, destb, srcb); err != nil {
+						return err
+					}
+				}
+				stale.Files = append(stale.Files, sf)
+			}
+		} else if write {
 			if err := os.Rename(src, dest); err != nil {
 				return err
 			}
+			wlog(config.Log, LogInfo, LogWrite, LogGeneral, "wrote: %s", dest)
 		} else {
-			fmt.Printf("unmodified: %s\n", dest)
+			wlog(config.Log, LogInfo, LogWrite, LogGeneral, "unmodified: %s", dest)
 			if err := os.Remove(src); err != nil {
 				return err
 			}
 		}
 	}
 
+	if len(stale.Files) > 0 {
+		return &stale
+	}
+
 	return nil
 }
 
@@ -309,6 +523,41 @@ func sortOutput(outputParts []string) {
 	})
 }
 
+// appendOutput appends the extra output to a file generated by msgp, then
+// fixes up its imports.
+func appendOutput(file string, extra []string) (rerr error) {
+	f, err := os.OpenFile(file, os.O_APPEND|os.O_WRONLY, 0600)
+	if err != nil {
+		return err
+	}
+	defer func() {
+		if cerr := f.Close(); cerr != nil && rerr == nil {
+			rerr = cerr
+		}
+	}()
+	sortOutput(extra)
+	for _, e := range extra {
+		if _, err := f.WriteString(e); err != nil {
+			return err
+		}
+	}
+	if err := f.Sync(); err != nil {
+		return err
+	}
+
+	src, err := ioutil.ReadFile(file)
+	if err != nil {
+		return err
+	}
+	// imports is supposed to be able to load data from a file, but that doesn't
+	// seem to work so we have to get the src ourselves.
+	p, err := imports.Process(file, src, nil)
+	if err != nil {
+		return err
+	}
+	return ioutil.WriteFile(file, p, 0600)
+}
+
 func hashFile(file string) (hash string, rerr error) {
 	f, err := os.Open(file)
 	if err != nil {
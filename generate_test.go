@@ -0,0 +1,155 @@
+package msgpgen_test
+
+import (
+	"bytes"
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"testing"
+
+	"github.com/shabbyrobe/msgpgen"
+	"github.com/shabbyrobe/msgpgen/msgpcmd"
+	"github.com/shabbyrobe/structer"
+)
+
+const testdataPkg = "github.com/shabbyrobe/msgpgen/testdata/"
+
+// goTool skips the test if it can't run the go tool.
+func goTool(t *testing.T) string {
+	t.Helper()
+	if testing.Short() {
+		t.Skip("runs the go tool")
+	}
+	tool, err := exec.LookPath("go")
+	if err != nil {
+		t.Skip("go tool not found")
+	}
+	return tool
+}
+
+// generate loads the package in testdata/name with a fresh type package set
+// and runs Generate on the named root types. globals are added as they would
+// be from a project file.
+func generate(t *testing.T, name string, state *msgpgen.State, config msgpgen.Config, globals []string, types ...string) error {
+	t.Helper()
+	tpset := structer.NewTypePackageSet()
+	dctvCache := msgpgen.NewDirectivesCache(tpset)
+	if err := msgpcmd.AddGlobalDirectives(dctvCache, msgpcmd.LoaderConfig{Directives: globals}); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := msgpcmd.LoadPackages(tpset, []string{"./" + filepath.ToSlash(filepath.Join("testdata", name))}); err != nil {
+		t.Fatal(err)
+	}
+	for _, typ := range types {
+		config.Types = append(config.Types, structer.TypeName{PackagePath: testdataPkg + name, Name: typ})
+	}
+	return msgpgen.Generate(tpset, state, dctvCache, config)
+}
+
+// removeGenerated removes the files Generate writes into testdata/name.
+func removeGenerated(name string) {
+	dir := filepath.Join("testdata", name)
+	os.Remove(filepath.Join(dir, name+"_msgp_gen.go"))
+	os.Remove(filepath.Join(dir, name+"_msgp_gen_test.go"))
+}
+
+// TestGenerateFlat generates an interface with the flat layout into
+// testdata/flat, then runs that package's tests, which round-trip values
+// through the generated code along with the generated tests.
+func TestGenerateFlat(t *testing.T) {
+	tool := goTool(t)
+	defer removeGenerated("flat")
+
+	config := msgpgen.NewConfig()
+	config.IDStrategy = msgpgen.IDStrategyHash
+	if err := generate(t, "flat", nil, config, nil, "Envelope"); err != nil {
+		t.Fatal(err)
+	}
+
+	// the generated tests, including the interceptor's Msgsize test, must be
+	// left in the package
+	tests, err := ioutil.ReadFile(filepath.Join("testdata", "flat", "flat_msgp_gen_test.go"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Contains(tests, []byte("func TestMsgsize_")) {
+		t.Fatal("generated tests have no TestMsgsize_ function")
+	}
+
+	out, err := exec.Command(tool, "test", "./testdata/flat").CombinedOutput()
+	if err != nil {
+		t.Fatalf("%v\n%s", err, out)
+	}
+}
+
+// TestGenerateThenCheck runs check mode straight after generating, which
+// must find nothing stale.
+func TestGenerateThenCheck(t *testing.T) {
+	goTool(t)
+	defer removeGenerated("flat")
+
+	config := msgpgen.NewConfig()
+	config.IDStrategy = msgpgen.IDStrategyHash
+	if err := generate(t, "flat", nil, config, nil, "Envelope"); err != nil {
+		t.Fatal(err)
+	}
+
+	config.Check = true
+	config.Diff = true
+	if err := generate(t, "flat", nil, config, nil, "Envelope"); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// TestGenerateStrictStateFormerly generates with -strict-state from a state
+// that has a type under the name given by its //msgp:formerly directive. The
+// rename is applied, rather than reported as a missing and an unassigned
+// type.
+func TestGenerateStrictStateFormerly(t *testing.T) {
+	goTool(t)
+	defer removeGenerated("renamed")
+
+	var state msgpgen.State
+	src := `{"Types": {"` + testdataPkg + `renamed.OldCreated": 7}}`
+	if err := json.Unmarshal([]byte(src), &state); err != nil {
+		t.Fatal(err)
+	}
+	if err := state.Init(); err != nil {
+		t.Fatal(err)
+	}
+
+	config := msgpgen.NewConfig()
+	config.StrictState = true
+	if err := generate(t, "renamed", &state, config, nil, "Envelope"); err != nil {
+		t.Fatal(err)
+	}
+
+	created := structer.TypeName{PackagePath: testdataPkg + "renamed", Name: "Created"}
+	iface := structer.TypeName{PackagePath: testdataPkg + "renamed", Name: "Msg"}
+	if id, ok := state.TypeID(iface, created); !ok || id != 7 {
+		t.Fatalf("expected %s to keep ID 7, found %d", created, id)
+	}
+}
+
+// TestGenerateGlobals generates a package that relies on a global shim for a
+// type from another package and a global ignore for a type that encodes
+// itself, then runs that package's tests.
+func TestGenerateGlobals(t *testing.T) {
+	tool := goTool(t)
+	defer removeGenerated("globals")
+
+	globals := []string{
+		"shim " + testdataPkg + "globals/stamp.Stamp as:int64 using:ToInt64/FromInt64",
+		"ignore " + testdataPkg + "globals.Token",
+	}
+	if err := generate(t, "globals", nil, msgpgen.NewConfig(), globals, "Record"); err != nil {
+		t.Fatal(err)
+	}
+
+	out, err := exec.Command(tool, "test", "./testdata/globals").CombinedOutput()
+	if err != nil {
+		t.Fatalf("%v\n%s", err, out)
+	}
+}
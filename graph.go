@@ -0,0 +1,182 @@
+package msgpgen
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+
+	"github.com/pkg/errors"
+)
+
+// GraphNode is a type discovered while walking the root types.
+type GraphNode struct {
+	Type     string   `json:"type"`
+	Package  string   `json:"package"`
+	Decision Decision `json:"decision,omitempty"`
+}
+
+// GraphEdge is a reference from one type to another. Label is the name of the
+// field that holds the reference, "elem" for the element of a named slice,
+// array, map or chan, or "implements" for an interface's implementers.
+type GraphEdge struct {
+	From  string `json:"from"`
+	To    string `json:"to"`
+	Label string `json:"label"`
+}
+
+// Graph is the graph of types discovered by the extractor. Assign one created
+// with NewGraph to Config.Graph to have Generate populate it.
+type Graph struct {
+	Nodes []*GraphNode `json:"nodes"`
+	Edges []GraphEdge  `json:"edges"`
+
+	nodes map[string]*GraphNode
+	edges map[GraphEdge]bool
+}
+
+func NewGraph() *Graph {
+	return &Graph{
+		nodes: make(map[string]*GraphNode),
+		edges: make(map[GraphEdge]bool),
+	}
+}
+
+func (g *Graph) node(name string) *GraphNode {
+	if n, ok := g.nodes[name]; ok {
+		return n
+	}
+	n := &GraphNode{Type: name}
+	if idx := strings.LastIndex(name, "."); idx > 0 {
+		n.Package = name[:idx]
+	}
+	g.nodes[name] = n
+	g.Nodes = append(g.Nodes, n)
+	return n
+}
+
+func (g *Graph) addEdge(from, to, label string) {
+	edge := GraphEdge{From: from, To: to, Label: label}
+	if g.edges[edge] {
+		return
+	}
+	g.edges[edge] = true
+	g.node(from)
+	g.node(to)
+	g.Edges = append(g.Edges, edge)
+}
+
+// decide records the decision for a type. The first decision other than
+// DecisionSeen wins; later ones come from the same type being reached via
+// another package.
+func (g *Graph) decide(name string, decision Decision) {
+	n := g.node(name)
+	if n.Decision == "" || n.Decision == DecisionSeen {
+		n.Decision = decision
+	}
+}
+
+func (g *Graph) sort() {
+	sort.Slice(g.Nodes, func(i, j int) bool { return g.Nodes[i].Type < g.Nodes[j].Type })
+	sort.Slice(g.Edges, func(i, j int) bool {
+		a, b := g.Edges[i], g.Edges[j]
+		if a.From != b.From {
+			return a.From < b.From
+		}
+		if a.To != b.To {
+			return a.To < b.To
+		}
+		return a.Label < b.Label
+	})
+}
+
+var graphColours = map[Decision]string{
+	DecisionSupported: "white",
+	DecisionSeen:      "white",
+	DecisionShimmed:   "khaki",
+	DecisionAutoShim:  "khaki",
+	DecisionIgnored:   "grey",
+	DecisionExtracted: "palegreen",
+	DecisionInterface: "lightblue",
+}
+
+// WriteDOT writes the graph in Graphviz DOT format. Types are grouped into a
+// cluster for each package and coloured by the decision made for them.
+func (g *Graph) WriteDOT(w io.Writer) error {
+	g.sort()
+
+	bw := bufio.NewWriter(w)
+	fmt.Fprintln(bw, "digraph msgpgen {")
+	fmt.Fprintln(bw, "  rankdir=LR;")
+	fmt.Fprintln(bw, "  node [shape=box, style=filled];")
+
+	var pkgs []string
+	byPkg := make(map[string][]*GraphNode)
+	for _, n := range g.Nodes {
+		if _, ok := byPkg[n.Package]; !ok {
+			pkgs = append(pkgs, n.Package)
+		}
+		byPkg[n.Package] = append(byPkg[n.Package], n)
+	}
+	sort.Strings(pkgs)
+
+	for i, pkg := range pkgs {
+		fmt.Fprintf(bw, "  subgraph cluster_%d {\n", i)
+		fmt.Fprintf(bw, "    label=%q;\n", pkg)
+		for _, n := range byPkg[pkg] {
+			colour := graphColours[n.Decision]
+			if colour == "" {
+				colour = "white"
+			}
+			fmt.Fprintf(bw, "    %q [label=%q, fillcolor=%q, tooltip=%q];\n",
+				n.Type, filepath.Base(n.Type), colour, string(n.Decision))
+		}
+		fmt.Fprintln(bw, "  }")
+	}
+
+	for _, e := range g.Edges {
+		style := ""
+		if e.Label == "implements" {
+			style = ", style=dashed"
+		}
+		fmt.Fprintf(bw, "  %q -> %q [label=%q%s];\n", e.From, e.To, e.Label, style)
+	}
+	fmt.Fprintln(bw, "}")
+	return bw.Flush()
+}
+
+func (g *Graph) WriteJSON(w io.Writer) error {
+	g.sort()
+	enc := json.NewEncoder(w)
+	enc.SetIndent("", "  ")
+	return enc.Encode(g)
+}
+
+// WriteFile writes the graph to a file, choosing the format from the
+// extension: ".dot" or ".gv" for DOT, ".json" for JSON.
+func (g *Graph) WriteFile(file string) (rerr error) {
+	var write func(w io.Writer) error
+	switch strings.ToLower(filepath.Ext(file)) {
+	case ".dot", ".gv":
+		write = g.WriteDOT
+	case ".json":
+		write = g.WriteJSON
+	default:
+		return errors.Errorf("unknown graph format for %s; expected .dot, .gv or .json", file)
+	}
+
+	f, err := os.Create(file)
+	if err != nil {
+		return err
+	}
+	defer func() {
+		if cerr := f.Close(); cerr != nil && rerr == nil {
+			rerr = cerr
+		}
+	}()
+	return write(f)
+}
@@ -0,0 +1,83 @@
+package msgpgen
+
+import (
+	"hash/fnv"
+
+	"github.com/pkg/errors"
+	"github.com/shabbyrobe/structer"
+)
+
+// IDStrategy selects how implementers of intercepted interfaces are given
+// their IDs.
+type IDStrategy string
+
+const (
+	// IDs are assigned sequentially and stored in the state file.
+	IDStrategyState IDStrategy = "state"
+
+	// IDs are derived by hashing the fully qualified type name, so no state
+	// file is needed. A //msgp:typeid directive overrides the hash.
+	IDStrategyHash IDStrategy = "hash"
+)
+
+// idAssigner gives each implementer of an intercepted interface its ID.
+type idAssigner interface {
+	// assignID gives t an ID as an implementer of iface. If pin is not zero,
+	// it was set by a //msgp:typeid directive and the ID must match it.
+	assignID(t, iface structer.TypeName, pin int) (int, error)
+
+	// TypeID returns the ID assigned to t as an implementer of iface.
+	TypeID(iface, t structer.TypeName) (int, bool)
+}
+
+var (
+	_ idAssigner = &State{}
+	_ idAssigner = &hashIDs{}
+)
+
+// HashTypeID returns the ID the hash strategy gives the type: the 32-bit
+// FNV-1a hash of the fully qualified name, masked to be positive.
+func HashTypeID(t structer.TypeName) int {
+	h := fnv.New32a()
+	h.Write([]byte(t.String()))
+	return int(h.Sum32() & 0x7fffffff)
+}
+
+type hashIDs struct {
+	types map[structer.TypeName]map[structer.TypeName]int
+	ids   map[structer.TypeName]map[int]structer.TypeName
+}
+
+func newHashIDs() *hashIDs {
+	return &hashIDs{
+		types: make(map[structer.TypeName]map[structer.TypeName]int),
+		ids:   make(map[structer.TypeName]map[int]structer.TypeName),
+	}
+}
+
+func (h *hashIDs) assignID(t, iface structer.TypeName, pin int) (int, error) {
+	if h.types[iface] == nil {
+		h.types[iface] = make(map[structer.TypeName]int)
+		h.ids[iface] = make(map[int]structer.TypeName)
+	}
+	if id, ok := h.types[iface][t]; ok {
+		return id, nil
+	}
+
+	id := pin
+	if id == 0 {
+		id = HashTypeID(t)
+	}
+	if other, ok := h.ids[iface][id]; ok {
+		return 0, errors.Errorf("%s and %s both have ID %d as implementers of %s; pin a different ID for one of them with //msgp:typeid",
+			other, t, id, iface)
+	}
+	h.types[iface][t] = id
+	h.ids[iface][id] = t
+	return id, nil
+}
+
+func (h *hashIDs) TypeID(iface, t structer.TypeName) (int, bool) {
+	id, ok := h.types[iface][t]
+	return id, ok
+}
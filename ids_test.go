@@ -0,0 +1,76 @@
+package msgpgen
+
+import (
+	"fmt"
+	"strings"
+	"testing"
+
+	"github.com/shabbyrobe/structer"
+)
+
+// hashCollision finds two type names in package p whose hashed IDs collide.
+func hashCollision(t *testing.T) (a, b structer.TypeName) {
+	t.Helper()
+	seen := make(map[int]structer.TypeName)
+	for i := 0; i < 1<<20; i++ {
+		tn := structer.TypeName{PackagePath: "p", Name: fmt.Sprintf("T%d", i)}
+		id := HashTypeID(tn)
+		if other, ok := seen[id]; ok {
+			return other, tn
+		}
+		seen[id] = tn
+	}
+	t.Fatal("no collision found")
+	return
+}
+
+func TestHashTypeID(t *testing.T) {
+	a := structer.TypeName{PackagePath: "github.com/foo/pkg", Name: "A"}
+	if HashTypeID(a) != HashTypeID(a) {
+		t.Fatal("hash is not stable")
+	}
+	if id := HashTypeID(a); id <= 0 {
+		t.Fatalf("expected a positive ID, found %d", id)
+	}
+	if HashTypeID(a) == HashTypeID(structer.TypeName{PackagePath: "github.com/foo/other", Name: "A"}) {
+		t.Fatal("same name in different packages should not collide")
+	}
+}
+
+func TestHashIDsCollision(t *testing.T) {
+	iface := structer.TypeName{PackagePath: "p", Name: "I"}
+	other := structer.TypeName{PackagePath: "p", Name: "J"}
+	a, b := hashCollision(t)
+
+	ids := newHashIDs()
+	id, err := ids.assignID(a, iface, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if again, err := ids.assignID(a, iface, 0); err != nil || again != id {
+		t.Fatalf("reassigning %s: %d, %v", a, again, err)
+	}
+
+	_, err = ids.assignID(b, iface, 0)
+	if err == nil || !strings.Contains(err.Error(), "both have ID") {
+		t.Fatalf("expected a collision error, found %v", err)
+	}
+	if _, ok := ids.TypeID(iface, b); ok {
+		t.Fatalf("%s was given an ID despite the collision", b)
+	}
+
+	// each interface has its own IDs, so the same hash can be used again
+	if _, err := ids.assignID(b, other, 0); err != nil {
+		t.Fatal(err)
+	}
+
+	// pinning a different ID resolves the collision, but a pin can collide
+	// as well
+	if pinned, err := ids.assignID(b, iface, 5); err != nil || pinned != 5 {
+		t.Fatalf("pinning %s: %d, %v", b, pinned, err)
+	}
+	c := structer.TypeName{PackagePath: "p", Name: "C"}
+	if _, err := ids.assignID(c, iface, 5); err == nil {
+		t.Fatal("expected a collision with the pinned ID")
+	}
+}
@@ -4,8 +4,10 @@ import (
 	"bytes"
 	"fmt"
 	"go/types"
+	"math"
 	"regexp"
 	"sort"
+	"strconv"
 	"strings"
 	"text/template"
 
@@ -17,9 +19,25 @@ import (
 type tplType struct {
 	ID            int
 	ImportName    string
+	ConstName     string
 	Pointer       bool
 	Shim          *ShimDirective
 	ShimPrimitive string
+
+	// Fully qualified name of the type, and the Go expression written as
+	// its discriminator.
+	TypeName string
+	Tag      string
+
+	// Exact number of bytes written around the value: the envelope and the
+	// discriminator.
+	Overhead int
+
+	// For shims, the Go expression for the size of the shimmed primitive.
+	// If SizeOfValue is set, the expression depends on the value, which is
+	// in tmp.
+	SizeExpr    string
+	SizeOfValue bool
 }
 
 type tplVars struct {
@@ -28,16 +46,444 @@ type tplVars struct {
 	OutType     string
 	Interceptor string
 	Types       []tplType
+
+	// Prefix of the names in the generated ID registry. Empty if the
+	// registry is not generated.
+	Registry string
+
+	Disc tplDisc
+
+	// Envelope layout: array, map or flat.
+	Layout string
+
+	// Receiver type of the generated decoding helpers.
+	Recv string
+
+	// For interfaces with an open registry: the interface's name, the
+	// qualifier for the registry's functions, and the expression written
+	// as the discriminator and the size of the envelope for any ID.
+	Iface        string
+	OpenPrefix   string
+	OpenTag      string
+	OpenOverhead int
+
+	// Name of the type that holds values with unknown IDs. Empty if unknown
+	// IDs are an error.
+	Unknown string
+}
+
+// tplDisc describes how the discriminator is written and which encodings
+// of it the decoders accept.
+type tplDisc struct {
+	// Suffix of the msgp Write and Append functions used to write it.
+	Method string
+
+	// Encodings accepted when decoding.
+	Int, String, Name bool
+
+	// Str is set if any string encoding is accepted, Multi if both integers
+	// and strings are.
+	Str, Multi bool
+}
+
+// interceptConfig holds the options that affect the generated interceptors.
+type interceptConfig struct {
+	// Generate an ID registry for each intercepted interface.
+	typeIDs bool
+
+	// How the discriminator is written, and any other encodings the decoders
+	// should accept.
+	discriminator Discriminator
+	accept        []Discriminator
+
+	layout Envelope
+
+	// Dispatch through a registry in the interface's package instead of a
+	// switch over the known implementers.
+	open bool
+
+	// Decode values with unknown IDs into a generated type instead of
+	// failing.
+	unknown bool
+}
+
+// unknownPrefix is prepended to an interface's name to name the type that
+// holds its values with unknown IDs.
+const unknownPrefix = "Unknown"
+
+// Envelope is the layout used to write the discriminator and the value of
+// an intercepted interface.
+type Envelope string
+
+const (
+	// A two element array: [discriminator, value]. This is the default.
+	EnvelopeArray Envelope = "array"
+
+	// A map with the discriminator in "t" and the value in "v".
+	EnvelopeMap Envelope = "map"
+
+	// The discriminator is added to the value's own map with the key "t".
+	// Every implementer must be encoded as a map, and must not have a field
+	// that is encoded as "t". Shimmed implementers use the map layout.
+	EnvelopeFlat Envelope = "flat"
+)
+
+func (e Envelope) valid() bool {
+	switch e {
+	case EnvelopeArray, EnvelopeMap, EnvelopeFlat:
+		return true
+	}
+	return false
+}
+
+// Discriminator is the encoding of the discriminator written before each
+// value of an intercepted interface.
+type Discriminator string
+
+const (
+	// The ID as a decimal string. This is the default, and the only form
+	// msgpgen used to support.
+	DiscriminatorString Discriminator = "string"
+
+	// The ID as a msgpack integer, which is smaller.
+	DiscriminatorInt Discriminator = "int"
+
+	// The fully qualified Go type name.
+	DiscriminatorName Discriminator = "name"
+)
+
+func (d Discriminator) valid() bool {
+	switch d {
+	case DiscriminatorString, DiscriminatorInt, DiscriminatorName:
+		return true
+	}
+	return false
+}
+
+func (c interceptConfig) disc() tplDisc {
+	var disc tplDisc
+	for _, d := range append([]Discriminator{c.discriminator}, c.accept...) {
+		switch d {
+		case DiscriminatorInt:
+			disc.Int = true
+		case DiscriminatorString:
+			disc.String = true
+		case DiscriminatorName:
+			disc.Name = true
+		}
+	}
+	disc.Str = disc.String || disc.Name
+	disc.Multi = disc.Int && disc.Str
+	disc.Method = "String"
+	if c.discriminator == DiscriminatorInt {
+		disc.Method = "Int64"
+	}
+	return disc
+}
+
+// tag returns the Go expression written as the discriminator for the type.
+func (c interceptConfig) tag(id int, tn structer.TypeName) string {
+	switch c.discriminator {
+	case DiscriminatorInt:
+		return strconv.Itoa(id)
+	case DiscriminatorName:
+		return strconv.Quote(tn.String())
+	default:
+		return strconv.Quote(strconv.Itoa(id))
+	}
+}
+
+// overhead returns the number of bytes written around a value of the type:
+// the envelope and the discriminator. For the flat layout, the value's own
+// map header is replaced, so this is an upper bound rather than exact.
+func (c interceptConfig) overhead(id int, tn structer.TypeName, shim bool) int {
+	var tag int
+	switch c.discriminator {
+	case DiscriminatorInt:
+		tag = intSize(int64(id))
+	case DiscriminatorName:
+		tag = strSize(len(tn.String()))
+	default:
+		tag = strSize(len(strconv.Itoa(id)))
+	}
+
+	key := strSize(1)
+	switch {
+	case c.layout == EnvelopeFlat && !shim:
+		// map header of up to 5 bytes, replacing the value's own, and "t"
+		return 5 + key + tag
+	case c.layout == EnvelopeMap || c.layout == EnvelopeFlat:
+		// fixmap header, "t" and "v"
+		return 1 + key + tag + key
+	default:
+		// fixarray header
+		return 1 + tag
+	}
+}
+
+// openOverhead returns the largest number of bytes written around a value
+// of an interface with an open registry, as the ID is not known until the
+// value is encoded.
+func (c interceptConfig) openOverhead() int {
+	// msgp.Int64Size, or the longest int64 in decimal
+	tag := 9
+	if c.discriminator == DiscriminatorString {
+		tag = strSize(20)
+	}
+	if c.layout == EnvelopeMap {
+		return 1 + strSize(1) + tag + strSize(1)
+	}
+	return 1 + tag
+}
+
+// openTag returns the Go expression written as the discriminator by an open
+// registry, in terms of id.
+func (c interceptConfig) openTag() string {
+	if c.discriminator == DiscriminatorInt {
+		return "id"
+	}
+	return "strconv.FormatInt(id, 10)"
+}
+
+// intSize returns the size of the integer as written by msgp.AppendInt64.
+func intSize(i int64) int {
+	switch {
+	case i >= 0 && i <= math.MaxInt8, i < 0 && i >= -32:
+		return 1
+	case i >= math.MinInt8 && i <= math.MaxInt8:
+		return 2
+	case i >= math.MinInt16 && i <= math.MaxInt16:
+		return 3
+	case i >= math.MinInt32 && i <= math.MaxInt32:
+		return 5
+	default:
+		return 9
+	}
+}
+
+// strSize returns the size of a string of n bytes as written by
+// msgp.AppendString.
+func strSize(n int) int {
+	switch {
+	case n < 32:
+		return 1 + n
+	case n <= math.MaxUint8:
+		return 2 + n
+	case n <= math.MaxUint16:
+		return 3 + n
+	default:
+		return 5 + n
+	}
+}
+
+// primitiveSizes maps msgp's primitive names to the Go expression for their
+// encoded size. %s is replaced by the value.
+var primitiveSizes = map[string]string{
+	"String":     "msgp.StringPrefixSize + len(%s)",
+	"Bytes":      "msgp.BytesPrefixSize + len(%s)",
+	"Bool":       "msgp.BoolSize",
+	"Byte":       "msgp.ByteSize",
+	"Int":        "msgp.IntSize",
+	"Int8":       "msgp.Int8Size",
+	"Int16":      "msgp.Int16Size",
+	"Int32":      "msgp.Int32Size",
+	"Int64":      "msgp.Int64Size",
+	"Uint":       "msgp.UintSize",
+	"Uint8":      "msgp.Uint8Size",
+	"Uint16":     "msgp.Uint16Size",
+	"Uint32":     "msgp.Uint32Size",
+	"Uint64":     "msgp.Uint64Size",
+	"Float32":    "msgp.Float32Size",
+	"Float64":    "msgp.Float64Size",
+	"Complex64":  "msgp.Complex64Size",
+	"Complex128": "msgp.Complex128Size",
+	"Time":       "msgp.TimeSize",
+}
+
+// primitiveSize returns the Go expression for the size of a shimmed
+// primitive, with the value in tmp, and whether it depends on the value.
+func primitiveSize(primitive string) (expr string, ofValue bool) {
+	expr, ok := primitiveSizes[primitive]
+	if !ok {
+		expr = "msgp.GuessSize(%s)"
+	}
+	if !strings.Contains(expr, "%s") {
+		return expr, false
+	}
+	return fmt.Sprintf(expr, "tmp"), true
 }
 
 var replacePattern = regexp.MustCompile(`[/\.]`)
 
-func genIntercept(tpset *structer.TypePackageSet, pkg string, directives *Directives, state *State, iface *iface) (out *bytes.Buffer, intercept *InterceptDirective, err error) {
-	tv := tplVars{}
+func genIntercept(tpset *structer.TypePackageSet, pkg string, directives *Directives, ids idAssigner, iface *iface, cfg interceptConfig) (out, tests *bytes.Buffer, intercept *InterceptDirective, err error) {
+	tv := tplVars{Disc: cfg.disc(), Layout: string(cfg.layout)}
+
+	if tv.Types, err = interceptTypes(tpset, pkg, directives, ids, iface, cfg); err != nil {
+		return
+	}
+
+	// Build mapper/interceptor type names
+	if tv.MapperType = mapperTypeName(iface.name); len(tv.MapperType) == 0 {
+		err = errors.Errorf("mapper name was empty for package %s, iface %s", pkg, iface.name)
+		return
+	}
+
+	tv.Recv = tv.MapperType
+	tv.MapperVar = fmt.Sprintf("%sInstance", tv.MapperType)
+	tv.Interceptor = fmt.Sprintf("%sInterceptor", tv.MapperType)
+
+	if tv.OutType, err = tpset.LocalImportName(iface.name, pkg); err != nil {
+		return
+	}
+
+	prefix := strings.TrimSuffix(tv.OutType, iface.name.Name)
+	if cfg.unknown {
+		tv.Unknown = prefix + unknownPrefix + iface.name.Name
+	}
+
+	name := ""
+	if cfg.open {
+		name = "openIntercept"
+		tv.Iface = iface.name.Name
+		tv.OpenPrefix = prefix
+	}
+
+	var tpl *template.Template
+	if tpl, err = parseInterceptTpl(); err != nil {
+		return
+	}
+	var buf, tbuf bytes.Buffer
+	if err = tpl.ExecuteTemplate(&buf, name, tv); err != nil {
+		err = errors.Wrap(err, "mapper template exec failed")
+		return
+	}
+	if err = tpl.ExecuteTemplate(&tbuf, "test", tv); err != nil {
+		err = errors.Wrap(err, "mapper test template exec failed")
+		return
+	}
+
+	intercept = &InterceptDirective{Type: iface.name.String(), Using: tv.Interceptor}
+	out, tests = &buf, &tbuf
+	return
+}
+
+// genRegistry generates the ID registry for an interface from its
+// implementers, which goes in the package that declares the interface so it
+// is only declared once.
+func genRegistry(iface *iface, tts []tplType) (*bytes.Buffer, error) {
+	tv := tplVars{
+		Types:    tts,
+		Registry: iface.name.Name,
+		OutType:  iface.name.Name,
+	}
+	registryConstNames(tv.Types)
+
+	tpl, err := parseInterceptTpl()
+	if err != nil {
+		return nil, err
+	}
+	var buf bytes.Buffer
+	if err := tpl.ExecuteTemplate(&buf, "registry", tv); err != nil {
+		return nil, errors.Wrap(err, "registry template exec failed")
+	}
+	return &buf, nil
+}
+
+// genOpenRegistry generates the registry for an interface with an open
+// registry, which goes in the package that declares the interface.
+func genOpenRegistry(iface *iface, cfg interceptConfig) (*bytes.Buffer, error) {
+	tv := tplVars{
+		Disc:         cfg.disc(),
+		Layout:       string(cfg.layout),
+		Recv:         mapperTypeName(iface.name) + "Registry",
+		OutType:      iface.name.Name,
+		Iface:        iface.name.Name,
+		OpenTag:      cfg.openTag(),
+		OpenOverhead: cfg.openOverhead(),
+	}
+	if cfg.unknown {
+		tv.Unknown = unknownPrefix + iface.name.Name
+	}
+
+	tpl, err := parseInterceptTpl()
+	if err != nil {
+		return nil, err
+	}
+	var buf bytes.Buffer
+	if err := tpl.ExecuteTemplate(&buf, "openRegistry", tv); err != nil {
+		return nil, errors.Wrap(err, "registry template exec failed")
+	}
+	return &buf, nil
+}
+
+// genUnknownType generates the type that holds values of the interface with
+// unknown IDs, which goes in the package that declares the interface.
+func genUnknownType(iface *iface) (*bytes.Buffer, error) {
+	tv := tplVars{OutType: iface.name.Name, Unknown: unknownPrefix + iface.name.Name}
+
+	tpl, err := parseInterceptTpl()
+	if err != nil {
+		return nil, err
+	}
+	var buf bytes.Buffer
+	if err := tpl.ExecuteTemplate(&buf, "unknownType", tv); err != nil {
+		return nil, errors.Wrap(err, "unknown type template exec failed")
+	}
+	return &buf, nil
+}
+
+// genOpenInit generates an init function that registers the implementers of
+// an interface with an open registry that are declared in pkg. It returns nil
+// if there are none.
+func genOpenInit(tpset *structer.TypePackageSet, pkg string, directives *Directives, ids idAssigner, iface *iface, cfg interceptConfig) (*bytes.Buffer, error) {
+	all, err := interceptTypes(tpset, pkg, directives, ids, iface, cfg)
+	if err != nil {
+		return nil, err
+	}
+
+	tv := tplVars{Iface: iface.name.Name}
+	for _, tt := range all {
+		if tn, _ := structer.ParseTypeName(tt.TypeName); tn.PackagePath == pkg {
+			tv.Types = append(tv.Types, tt)
+		}
+	}
+	if len(tv.Types) == 0 {
+		return nil, nil
+	}
+
+	if tv.OutType, err = tpset.LocalImportName(iface.name, pkg); err != nil {
+		return nil, err
+	}
+	tv.OpenPrefix = strings.TrimSuffix(tv.OutType, tv.Iface)
+
+	tpl, err := parseInterceptTpl()
+	if err != nil {
+		return nil, err
+	}
+	var buf bytes.Buffer
+	if err := tpl.ExecuteTemplate(&buf, "openInit", tv); err != nil {
+		return nil, errors.Wrap(err, "registration template exec failed")
+	}
+	return &buf, nil
+}
+
+func parseInterceptTpl() (*template.Template, error) {
+	tpl, err := template.New("").Parse(interceptTpl)
+	if err == nil {
+		tpl, err = tpl.Parse(openTpl)
+	}
+	if err != nil {
+		return nil, errors.Wrap(err, "mapper template parse failed")
+	}
+	return tpl, nil
+}
+
+// interceptTypes returns the implementers of the interface that can be
+// referred to from pkg, sorted by ID.
+func interceptTypes(tpset *structer.TypePackageSet, pkg string, directives *Directives, ids idAssigner, iface *iface, cfg interceptConfig) (tts []tplType, err error) {
 	var localName string
 
-	// Build types
-	tv.Types = make([]tplType, 0, len(iface.types))
+	tts = make([]tplType, 0, len(iface.types))
 	for tn, typ := range iface.types {
 		otn := tn
 		if !tn.IsExported() {
@@ -71,11 +517,11 @@ func genIntercept(tpset *structer.TypePackageSet, pkg string, directives *Direct
 			ptr = true
 		}
 
-		if _, ok := directives.ignore[tn]; ok {
+		if directives.isIgnored(tn) {
 			continue
 		}
 
-		id, ok := state.Types[tn]
+		id, ok := ids.TypeID(iface.name, tn)
 		if !ok {
 			err = errors.Errorf("id not found for package %s, type %s, iface %s", pkg, tn.String(), iface.name)
 			return
@@ -86,54 +532,70 @@ func genIntercept(tpset *structer.TypePackageSet, pkg string, directives *Direct
 		}
 
 		tt := tplType{
-			Shim:       directives.shim[tn],
+			Shim:       directives.shimFor(tn),
 			ID:         id,
 			ImportName: localName,
 			Pointer:    ptr,
+			TypeName:   tn.String(),
+			Tag:        cfg.tag(id, tn),
+		}
+		if tt.Shim != nil && cfg.open {
+			err = errors.Errorf("%s implements %s, which has an open registry, so it cannot be shimmed", tn, iface.name)
+			return
 		}
 		if tt.Shim != nil {
 			tt.ShimPrimitive = gen.Ident(tt.Shim.As).Value.String()
+			tt.SizeExpr, tt.SizeOfValue = primitiveSize(tt.ShimPrimitive)
 		}
+		tt.Overhead = cfg.overhead(id, tn, tt.Shim != nil)
 
-		tv.Types = append(tv.Types, tt)
+		tts = append(tts, tt)
 	}
 
-	sort.Slice(tv.Types, func(i, j int) bool {
-		return tv.Types[i].ID < tv.Types[j].ID
+	sort.Slice(tts, func(i, j int) bool {
+		return tts[i].ID < tts[j].ID
 	})
+	return tts, nil
+}
 
-	// Build mapper/interceptor type names
-	tv.MapperType = iface.name.String()
-	if len(tv.MapperType) == 0 {
-		err = errors.Errorf("mapper name was empty for package %s, iface %s", pkg, iface.name)
-		return
+// registryConstNames names the ID constant for each type after the type, or
+// after its package and the type if two types share a name.
+func registryConstNames(tts []tplType) {
+	names := make(map[string]int)
+	for _, tt := range tts {
+		names[typeNamePart(tt.ImportName)]++
 	}
-	tv.MapperType = replacePattern.ReplaceAllString(tv.MapperType, "ー")
-	tv.MapperType = strings.Trim(tv.MapperType, "ー")
-	tv.MapperType = strings.ToLower(tv.MapperType[:1]) + tv.MapperType[1:]
-
-	tv.MapperVar = fmt.Sprintf("%sInstance", tv.MapperType)
-	tv.Interceptor = fmt.Sprintf("%sInterceptor", tv.MapperType)
-
-	if tv.OutType, err = tpset.LocalImportName(iface.name, pkg); err != nil {
-		return
+	for i, tt := range tts {
+		name := typeNamePart(tt.ImportName)
+		if names[name] > 1 {
+			if dot := strings.LastIndex(tt.ImportName, "."); dot > 0 {
+				pkg := tt.ImportName[:dot]
+				name = strings.ToUpper(pkg[:1]) + pkg[1:] + name
+			}
+		}
+		tts[i].ConstName = name
 	}
+}
 
-	var tpl *template.Template
-	tpl, err = template.New("").Parse(interceptTpl)
-	if err != nil {
-		err = errors.Wrap(err, "mapper template parse failed")
-		return
-	}
-	var buf bytes.Buffer
-	if err = tpl.Execute(&buf, tv); err != nil {
-		err = errors.Wrap(err, "mapper template exec failed")
-		return
+func typeNamePart(importName string) string {
+	return importName[strings.LastIndex(importName, ".")+1:]
+}
+
+// mapperTypeName returns the name of the unexported type generated to
+// intercept the interface.
+func mapperTypeName(iface structer.TypeName) string {
+	name := replacePattern.ReplaceAllString(iface.String(), "ー")
+	name = strings.Trim(name, "ー")
+	if len(name) == 0 {
+		return ""
 	}
+	return strings.ToLower(name[:1]) + name[1:]
+}
 
-	intercept = &InterceptDirective{Type: iface.name.String(), Using: tv.Interceptor}
-	out = &buf
-	return
+// interceptDirective describes the intercept directive that will be
+// generated for the interface, for reporting.
+func interceptDirective(iface structer.TypeName) string {
+	return fmt.Sprintf("//msgp:intercept %s using:%sInterceptor", iface, mapperTypeName(iface))
 }
 
 const interceptTpl = `
@@ -146,7 +608,35 @@ type {{.MapperType}} struct {}
 func (m *{{.MapperType}}) DecodeMsg(dc *msgp.Reader) (t {{.OutType}}, err error) {
 	if dc.IsNil() {
 		err = dc.ReadNil()
+	{{- if .Unknown }}
+	} else {
+		// the whole value is read first so it can be kept if its ID is
+		// unknown
+		var raw msgp.Raw
+		if err = raw.DecodeMsg(dc); err != nil {
+			return
+		}
+		t, _, err = m.UnmarshalMsg(raw)
+	}
+	{{- else }}
 	} else {
+		{{- if ne .Layout "array" }}
+		var next msgp.Type
+		if next, err = dc.NextType(); err != nil {
+			return
+		}
+		if next != msgp.ArrayType {
+			var raw msgp.Raw
+			if err = raw.DecodeMsg(dc); err != nil {
+				return
+			}
+			t, err = m.unmarshalEnvelope(raw)
+			return
+		}
+
+		// arrays are always accepted so data written before the layout was
+		// changed can still be read
+		{{- end }}
 		var sz uint32
 		sz, err = dc.ReadArrayHeader()
 		if err != nil {
@@ -156,18 +646,9 @@ func (m *{{.MapperType}}) DecodeMsg(dc *msgp.Reader) (t {{.OutType}}, err error)
 			err = msgp.ArrayError{Wanted: 2, Got: sz}
 			return
 		}
-		
-		// Y U string? numbers are a minefield for client libraries in msgpack
-		var s string
+
 		var i int64
-		s, err = dc.ReadString()
-		if err != nil {
-			return
-		}
-		i, err = strconv.ParseInt(s, 10, 64)
-		if err != nil {
-			return
-		}
+		{{- template "readTag" . }}
 
 		switch i {
 		{{- range .Types }}
@@ -196,6 +677,7 @@ func (m *{{.MapperType}}) DecodeMsg(dc *msgp.Reader) (t {{.OutType}}, err error)
 			err = fmt.Errorf("{{.OutType}}: unknown msg kind %d", i)
 		}
 	}
+	{{- end }}
 	return
 }
 
@@ -204,6 +686,18 @@ func (m *{{.MapperType}}) UnmarshalMsg(bts []byte) (t {{.OutType}}, o []byte, er
 	if msgp.IsNil(bts) {
 		o, err = msgp.ReadNilBytes(o)
 	} else {
+		{{- if ne .Layout "array" }}
+		if msgp.NextType(o) != msgp.ArrayType {
+			if o, err = msgp.Skip(o); err != nil {
+				return
+			}
+			t, err = m.unmarshalEnvelope(bts[:len(bts)-len(o)])
+			return
+		}
+
+		// arrays are always accepted so data written before the layout was
+		// changed can still be read
+		{{- end }}
 		var sz uint32
 		sz, o, err = msgp.ReadArrayHeaderBytes(o)
 		if err != nil {
@@ -213,17 +707,9 @@ func (m *{{.MapperType}}) UnmarshalMsg(bts []byte) (t {{.OutType}}, o []byte, er
 			err = msgp.ArrayError{Wanted: 2, Got: sz}
 			return
 		}
-		// Y U string? numbers are a minefield for client libraries in msgpack
-		var s string
 		var i int64
-		s, o, err = msgp.ReadStringBytes(o)
-		if err != nil {
-			return
-		}
-		i, err = strconv.ParseInt(s, 10, 64)
-		if err != nil {
-			return
-		}
+		{{- template "readTagBytes" . }}
+
 		switch i {
 		{{- range .Types }}
 		case {{.ID}}:
@@ -247,7 +733,14 @@ func (m *{{.MapperType}}) UnmarshalMsg(bts []byte) (t {{.OutType}}, o []byte, er
 
 		{{- end }}
 		default:
+			{{- if .Unknown }}
+			if o, err = msgp.Skip(o); err != nil {
+				return
+			}
+			t = &{{.Unknown}}{ID: i, Raw: append(msgp.Raw(nil), bts[:len(bts)-len(o)]...)}
+			{{- else }}
 			err = fmt.Errorf("{{.OutType}}: unknown msg kind %d", i)
+			{{- end }}
 		}
 	}
 	return
@@ -257,19 +750,55 @@ func (m *{{.MapperType}}) EncodeMsg(t {{.OutType}}, en *msgp.Writer) (err error)
 	if t == nil {
 		return en.WriteNil()
 	}
+	{{- template "writeUnknown" . }}
+
+	{{- if eq .Layout "array" }}
 
 	// array header, size 2
 	err = en.Append(0x92)
 	if err != nil {
 		return err
 	}
+	{{- end }}
 
 	switch t := t.(type) {
 	{{- range .Types }}
 	case {{ if .Pointer -}} * {{- end -}} {{.ImportName}}:
-		if err = en.WriteString("{{.ID}}"); err != nil {
+		{{- if and (eq $.Layout "flat") (not .Shim) }}
+		var body []byte
+		if body, err = t.MarshalMsg(nil); err != nil {
+			return
+		}
+		var sz uint32
+		if sz, body, err = msgp.ReadMapHeaderBytes(body); err != nil {
+			return
+		}
+		if err = en.WriteMapHeader(sz + 1); err != nil {
 			return
 		}
+		if err = en.WriteString("t"); err != nil {
+			return
+		}
+		if err = en.Write{{$.Disc.Method}}({{.Tag}}); err != nil {
+			return
+		}
+		_, err = en.Write(body)
+		{{- else }}
+		{{- if ne $.Layout "array" }}
+		// map header, size 2, key "t"
+		if err = en.Append(0x82, 0xa1, 't'); err != nil {
+			return
+		}
+		{{- end }}
+		if err = en.Write{{$.Disc.Method}}({{.Tag}}); err != nil {
+			return
+		}
+		{{- if ne $.Layout "array" }}
+		// key "v"
+		if err = en.Append(0xa1, 'v'); err != nil {
+			return
+		}
+		{{- end }}
 
 		{{- if .Shim }}
 		{{- if (eq .Shim.Mode "convert") }}
@@ -285,6 +814,7 @@ func (m *{{.MapperType}}) EncodeMsg(t {{.OutType}}, en *msgp.Writer) (err error)
 		{{- else }}
 		err = t.EncodeMsg(en)
 		{{- end}}
+		{{- end}}
 	{{- end }}
 	default:
 		err = fmt.Errorf("{{.OutType}} unknown msg %T", t)
@@ -298,14 +828,40 @@ func (m *{{.MapperType}}) MarshalMsg(t {{.OutType}}, b []byte) (o []byte, err er
 		o = msgp.AppendNil(o)
 		return
 	}
+	{{- template "appendUnknown" . }}
+
+	{{- if eq .Layout "array" }}
 
 	// array header, size 2
 	o = append(o, 0x92)
+	{{- end }}
 
 	switch t := t.(type) {
 	{{- range .Types }}
 	case {{ if .Pointer -}} * {{- end -}} {{.ImportName}}:
-		o = msgp.AppendString(o, "{{.ID}}")
+		{{- if and (eq $.Layout "flat") (not .Shim) }}
+		var body []byte
+		if body, err = t.MarshalMsg(nil); err != nil {
+			return
+		}
+		var sz uint32
+		if sz, body, err = msgp.ReadMapHeaderBytes(body); err != nil {
+			return
+		}
+		o = msgp.AppendMapHeader(o, sz+1)
+		o = msgp.AppendString(o, "t")
+		o = msgp.Append{{$.Disc.Method}}(o, {{.Tag}})
+		o = append(o, body...)
+		{{- else }}
+		{{- if ne $.Layout "array" }}
+		// map header, size 2, key "t"
+		o = append(o, 0x82, 0xa1, 't')
+		{{- end }}
+		o = msgp.Append{{$.Disc.Method}}(o, {{.Tag}})
+		{{- if ne $.Layout "array" }}
+		// key "v"
+		o = append(o, 0xa1, 'v')
+		{{- end }}
 
 		{{- if .Shim }}
 		{{- if (eq .Shim.Mode "convert") }}
@@ -321,6 +877,7 @@ func (m *{{.MapperType}}) MarshalMsg(t {{.OutType}}, b []byte) (o []byte, err er
 		{{- else }}
 		o, err = t.MarshalMsg(o)
 		{{- end}}
+		{{- end}}
 
 	{{- end }}
 	default:
@@ -330,12 +887,797 @@ func (m *{{.MapperType}}) MarshalMsg(t {{.OutType}}, b []byte) (o []byte, err er
 	return
 }
 
-func (m *{{.MapperType}}) Msgsize(t {{.OutType}}) (s int) {
-	switch t := t.(type) {
-	case msgp.Sizer:
-		return t.Msgsize()
-	default:
-		return msgp.GuessSize(t)
-	}
+{{- if ne .Layout "array" }}
+
+// unmarshalEnvelope decodes a value written in the {{.Layout}} layout.
+func (m *{{.MapperType}}) unmarshalEnvelope(b []byte) (t {{.OutType}}, err error) {
+	var i int64
+	var v []byte
+	if i, v, err = m.readEnvelope(b); err != nil {
+		return
+	}
+
+	switch i {
+	{{- range .Types }}
+	case {{.ID}}:
+		{{- if and (eq $.Layout "flat") (not .Shim) }}
+		// the discriminator is one of the keys of the value's own map
+		v = b
+		{{- else }}
+		if v == nil {
+			err = fmt.Errorf("{{$.OutType}}: envelope has no value")
+			return
+		}
+		{{- end }}
+
+		{{- if .Shim }}
+		var as {{.Shim.As}}
+		if as, _, err = msgp.Read{{.ShimPrimitive}}Bytes(v); err != nil {
+			return
+		}
+
+		{{- if (eq .Shim.Mode "convert") }}
+		t, err = {{.Shim.FromFunc}}(as)
+		{{- else }}
+		t = {{.Shim.FromFunc}}(as)
+		{{- end }}
+
+		{{- else }}
+		x := {{if .Pointer}}&{{end}}{{.ImportName}}{}
+		if _, err = x.UnmarshalMsg(v); err != nil {
+			return
+		}
+		t = x
+		{{- end }}
+	{{- end }}
+	default:
+		{{- if .Unknown }}
+		t = &{{.Unknown}}{ID: i, Raw: append(msgp.Raw(nil), b...)}
+		{{- else }}
+		err = fmt.Errorf("{{.OutType}}: unknown msg kind %d", i)
+		{{- end }}
+	}
+	return
+}
+
+{{- template "readEnvelope" . }}
+{{- end }}
+
+{{- if .Disc.Str }}
+
+{{- template "parseTag" . }}
+{{- end }}
+
+func (m *{{.MapperType}}) Msgsize(t {{.OutType}}) (s int) {
+	switch t := t.(type) {
+	case nil:
+		return msgp.NilSize
+	{{- if .Unknown }}
+	case *{{.Unknown}}:
+		return len(t.Raw)
+	{{- end }}
+	{{- range .Types }}
+	case {{ if .Pointer -}} * {{- end -}} {{.ImportName}}:
+		s = {{.Overhead}}
+		{{- if .Shim }}
+		{{- if .SizeOfValue }}
+		{{- if (eq .Shim.Mode "convert") }}
+		tmp, err := {{.Shim.ToFunc}}(t)
+		if err != nil {
+			// MarshalMsg will fail as well
+			return
+		}
+		{{- else }}
+		tmp := {{.Shim.As}}(t)
+		{{- end }}
+		{{- end }}
+		s += {{.SizeExpr}}
+		{{- else }}
+		s += t.Msgsize()
+		{{- end }}
+	{{- end }}
+	case msgp.Sizer:
+		return t.Msgsize()
+	default:
+		return msgp.GuessSize(t)
+	}
+	return
+}
+
+
+{{- define "writeUnknown" }}
+	{{- if .Unknown }}
+	if u, ok := t.(*{{.Unknown}}); ok {
+		// written back exactly as it was read
+		_, err = en.Write(u.Raw)
+		return
+	}
+	{{- end }}
+{{- end }}
+
+{{- define "appendUnknown" }}
+	{{- if .Unknown }}
+	if u, ok := t.(*{{.Unknown}}); ok {
+		// written back exactly as it was read
+		o = append(o, u.Raw...)
+		return
+	}
+	{{- end }}
+{{- end }}
+
+{{- define "readTag" }}
+		{{- if .Disc.Multi }}
+		var typ msgp.Type
+		if typ, err = dc.NextType(); err != nil {
+			return
+		}
+		switch typ {
+		case msgp.IntType, msgp.UintType:
+			i, err = dc.ReadInt64()
+		case msgp.StrType:
+			var s string
+			if s, err = dc.ReadString(); err != nil {
+				return
+			}
+			i, err = m.parseTag(s)
+		default:
+			err = fmt.Errorf("{{.OutType}}: unexpected msg kind type %s", typ)
+		}
+		{{- else if .Disc.Int }}
+		i, err = dc.ReadInt64()
+		{{- else }}
+		var s string
+		if s, err = dc.ReadString(); err != nil {
+			return
+		}
+		i, err = m.parseTag(s)
+		{{- end }}
+		if err != nil {
+			return
+		}
+{{- end }}
+
+{{- define "readTagBytes" }}
+		{{- if .Disc.Multi }}
+		switch typ := msgp.NextType(o); typ {
+		case msgp.IntType, msgp.UintType:
+			i, o, err = msgp.ReadInt64Bytes(o)
+		case msgp.StrType:
+			var s string
+			if s, o, err = msgp.ReadStringBytes(o); err != nil {
+				return
+			}
+			i, err = m.parseTag(s)
+		default:
+			err = fmt.Errorf("{{.OutType}}: unexpected msg kind type %s", typ)
+		}
+		{{- else if .Disc.Int }}
+		i, o, err = msgp.ReadInt64Bytes(o)
+		{{- else }}
+		var s string
+		if s, o, err = msgp.ReadStringBytes(o); err != nil {
+			return
+		}
+		i, err = m.parseTag(s)
+		{{- end }}
+		if err != nil {
+			return
+		}
+{{- end }}
+
+{{- define "test" }}
+
+func TestMsgsize_{{.MapperType}}(t *testing.T) {
+	// each implementer is checked with its zero value and with every field
+	// msgp can see filled in. the filled values may not survive a
+	// mode:convert shim's conversion, so those are only checked if they
+	// encode; the same goes for the zero values of shimmed implementers.
+	values := []struct {
+		v      {{.OutType}}
+		strict bool
+	}{
+		{nil, true},
+		{{- range .Types }}
+		{{- $strict := not (and .Shim (eq .Shim.Mode "convert")) }}
+		{{- if .Pointer }}
+		{new({{.ImportName}}), true},
+		{msgsizeFill_{{$.MapperType}}(new({{.ImportName}})).(*{{.ImportName}}), false},
+		{{- else if .Shim }}
+		{*new({{.ImportName}}), {{$strict}}},
+		{*msgsizeFill_{{$.MapperType}}(new({{.ImportName}})).(*{{.ImportName}}), false},
+		{{- else }}
+		{ {{- .ImportName}}{}, true},
+		{*msgsizeFill_{{$.MapperType}}(new({{.ImportName}})).(*{{.ImportName}}), false},
+		{{- end }}
+		{{- end }}
+	}
+	for _, c := range values {
+		bts, err := {{.MapperVar}}.MarshalMsg(c.v, nil)
+		if err != nil {
+			if c.strict {
+				t.Fatal(err)
+			}
+			t.Logf("%T: skipped, as MarshalMsg failed: %v", c.v, err)
+			continue
+		}
+		if s := {{.MapperVar}}.Msgsize(c.v); s < len(bts) {
+			t.Fatalf("%T: Msgsize() is %d, but MarshalMsg wrote %d bytes", c.v, s, len(bts))
+		}
+	}
+}
+
+// msgsizeFill_{{.MapperType}} sets everything reachable from the pointer p to
+// non-zero values, using the largest encoding for each number and strings
+// longer than msgp's short forms, and returns p. Interfaces are left nil.
+func msgsizeFill_{{.MapperType}}(p interface{}) interface{} {
+	n := 0
+	var fill func(v reflect.Value, depth int)
+	fill = func(v reflect.Value, depth int) {
+		if depth > 5 || !v.CanSet() {
+			return
+		}
+		n++
+		switch v.Kind() {
+		case reflect.Bool:
+			v.SetBool(true)
+		case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+			v.SetInt(-1<<uint(v.Type().Bits()-1) + int64(n))
+		case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64, reflect.Uintptr:
+			v.SetUint(^uint64(0)>>uint(64-v.Type().Bits()) - uint64(n))
+		case reflect.Float32, reflect.Float64:
+			v.SetFloat(float64(n) + 0.5)
+		case reflect.Complex64, reflect.Complex128:
+			v.SetComplex(complex(float64(n), 0.5))
+		case reflect.String:
+			v.SetString(fmt.Sprintf("%040d", n))
+		case reflect.Ptr:
+			v.Set(reflect.New(v.Type().Elem()))
+			fill(v.Elem(), depth+1)
+		case reflect.Struct:
+			for i := 0; i < v.NumField(); i++ {
+				fill(v.Field(i), depth+1)
+			}
+		case reflect.Array:
+			for i := 0; i < v.Len(); i++ {
+				fill(v.Index(i), depth+1)
+			}
+		case reflect.Slice:
+			s := reflect.MakeSlice(v.Type(), 3, 3)
+			for i := 0; i < s.Len(); i++ {
+				fill(s.Index(i), depth+1)
+			}
+			v.Set(s)
+		case reflect.Map:
+			m := reflect.MakeMap(v.Type())
+			for i := 0; i < 3; i++ {
+				k := reflect.New(v.Type().Key()).Elem()
+				e := reflect.New(v.Type().Elem()).Elem()
+				fill(k, depth+1)
+				fill(e, depth+1)
+				m.SetMapIndex(k, e)
+			}
+			v.Set(m)
+		}
+	}
+	fill(reflect.ValueOf(p).Elem(), 0)
+	return p
+}
+{{- end }}
+
+{{- define "readEnvelope" }}
+
+// readEnvelope returns the discriminator from the "t" key of a map and the
+// raw value of its "v" key, if there is one.
+func (m *{{.Recv}}) readEnvelope(b []byte) (i int64, v []byte, err error) {
+	var sz uint32
+	o := b
+	if sz, o, err = msgp.ReadMapHeaderBytes(o); err != nil {
+		return
+	}
+	found := false
+	for ; sz > 0; sz-- {
+		var key []byte
+		if key, o, err = msgp.ReadMapKeyZC(o); err != nil {
+			return
+		}
+		switch msgp.UnsafeString(key) {
+		case "t":
+			{{- template "readTagBytes" . }}
+			found = true
+		case "v":
+			start := o
+			if o, err = msgp.Skip(o); err != nil {
+				return
+			}
+			v = start[:len(start)-len(o)]
+		default:
+			if o, err = msgp.Skip(o); err != nil {
+				return
+			}
+		}
+	}
+	if !found {
+		err = fmt.Errorf("{{.OutType}}: envelope has no discriminator")
+	}
+	return
+}
+{{- end }}
+
+{{- define "parseTag" }}
+
+// parseTag returns the ID for a discriminator that was written as a string.
+func (m *{{.Recv}}) parseTag(s string) (int64, error) {
+	{{- if .Disc.Name }}
+	switch s {
+	{{- range .Types }}
+	case {{printf "%q" .TypeName}}:
+		return {{.ID}}, nil
+	{{- end }}
+	}
+	{{- end }}
+	{{- if .Disc.String }}
+	// Y U string? numbers are a minefield for client libraries in msgpack
+	return strconv.ParseInt(s, 10, 64)
+	{{- else }}
+	return 0, fmt.Errorf("{{.OutType}}: unknown msg kind %q", s)
+	{{- end }}
+}
+{{- end }}
+
+{{- define "registry" }}
+{{- if .Registry }}
+
+// IDs of the implementers of {{.OutType}}, assigned by msgpgen.
+const (
+	{{- range .Types }}
+	{{$.Registry}}ID{{.ConstName}} = {{.ID}}
+	{{- end }}
+)
+
+// {{.Registry}}IDs lists the ID of every implementer of {{.OutType}}, sorted.
+var {{.Registry}}IDs = []int{
+	{{- range .Types }}
+	{{$.Registry}}ID{{.ConstName}},
+	{{- end }}
+}
+
+// {{.Registry}}TypeID returns the ID of the type of v.
+func {{.Registry}}TypeID(v {{.OutType}}) (int, bool) {
+	switch v.(type) {
+	{{- range .Types }}
+	case {{ if .Pointer -}} * {{- end -}} {{.ImportName}}:
+		return {{$.Registry}}ID{{.ConstName}}, true
+	{{- end }}
+	}
+	return 0, false
+}
+
+// New{{.Registry}}ByID returns a new, empty value of the type with the given ID.
+func New{{.Registry}}ByID(id int) ({{.OutType}}, error) {
+	switch id {
+	{{- range .Types }}
+	case {{$.Registry}}ID{{.ConstName}}:
+		{{- if .Pointer }}
+		return new({{.ImportName}}), nil
+		{{- else if .Shim }}
+		return *new({{.ImportName}}), nil
+		{{- else }}
+		return {{.ImportName}}{}, nil
+		{{- end }}
+	{{- end }}
+	}
+	return nil, fmt.Errorf("{{.OutType}}: unknown ID %d", id)
+}
+{{- end }}
+{{- end }}
+`
+
+// openTpl holds the templates used for interfaces with an open registry. It
+// is parsed along with interceptTpl, whose tag readers it shares.
+const openTpl = `
+{{- define "openRegistry" }}
+
+type {{.Recv}} struct {
+	sync.RWMutex
+	byID   map[int64]func() {{.OutType}}
+	byType map[reflect.Type]int64
+}
+
+var {{.Recv}}Instance = &{{.Recv}}{
+	byID:   make(map[int64]func() {{.OutType}}),
+	byType: make(map[reflect.Type]int64),
+}
+
+// Register{{.Iface}} adds an implementer of {{.OutType}} to its registry. fn
+// must return a new, empty value of the type. It panics if the ID or the
+// type is already registered.
+func Register{{.Iface}}(id int64, fn func() {{.OutType}}) {
+	{{.Recv}}Instance.register(id, fn)
+}
+
+// Decode{{.Iface}} reads a {{.OutType}} written by Encode{{.Iface}} or Marshal{{.Iface}}.
+func Decode{{.Iface}}(dc *msgp.Reader) ({{.OutType}}, error) {
+	return {{.Recv}}Instance.DecodeMsg(dc)
+}
+
+// Unmarshal{{.Iface}} reads a {{.OutType}} written by Encode{{.Iface}} or Marshal{{.Iface}}.
+func Unmarshal{{.Iface}}(bts []byte) ({{.OutType}}, []byte, error) {
+	return {{.Recv}}Instance.UnmarshalMsg(bts)
+}
+
+// Encode{{.Iface}} writes t with the ID it was registered with.
+func Encode{{.Iface}}(t {{.OutType}}, en *msgp.Writer) error {
+	return {{.Recv}}Instance.EncodeMsg(t, en)
+}
+
+// Marshal{{.Iface}} appends t to b with the ID it was registered with.
+func Marshal{{.Iface}}(t {{.OutType}}, b []byte) ([]byte, error) {
+	return {{.Recv}}Instance.MarshalMsg(t, b)
+}
+
+// Msgsize{{.Iface}} returns an upper bound for the size of t once encoded.
+func Msgsize{{.Iface}}(t {{.OutType}}) int {
+	return {{.Recv}}Instance.Msgsize(t)
+}
+
+func (m *{{.Recv}}) register(id int64, fn func() {{.OutType}}) {
+	rt := reflect.TypeOf(fn())
+	m.Lock()
+	defer m.Unlock()
+	if other, ok := m.byID[id]; ok {
+		panic(fmt.Sprintf("{{.OutType}}: cannot register %s with ID %d, which is already registered to %T", rt, id, other()))
+	}
+	if other, ok := m.byType[rt]; ok {
+		panic(fmt.Sprintf("{{.OutType}}: cannot register %s with ID %d, it is already registered with ID %d", rt, id, other))
+	}
+	m.byID[id] = fn
+	m.byType[rt] = id
+}
+
+func (m *{{.Recv}}) id(t {{.OutType}}) (int64, error) {
+	m.RLock()
+	id, ok := m.byType[reflect.TypeOf(t)]
+	m.RUnlock()
+	if !ok {
+		return 0, fmt.Errorf("{{.OutType}} unknown msg %T", t)
+	}
+	return id, nil
 }
+
+// value returns a new value for the ID, and a pointer to decode into. If
+// the registered type is not a pointer, the decoded value must be fetched
+// with result.
+{{- if .Unknown }} If the ID is not registered, ptr is nil.{{ end }}
+func (m *{{.Recv}}) value(id int64) (t {{.OutType}}, ptr interface{}, err error) {
+	m.RLock()
+	fn, ok := m.byID[id]
+	m.RUnlock()
+	if !ok {
+		{{- if not .Unknown }}
+		err = fmt.Errorf("{{.OutType}}: unknown msg kind %d", id)
+		{{- end }}
+		return
+	}
+	t = fn()
+	return t, m.ptr(t), nil
+}
+
+func (m *{{.Recv}}) result(t {{.OutType}}, ptr interface{}) {{.OutType}} {
+	if reflect.TypeOf(t).Kind() == reflect.Ptr {
+		return t
+	}
+	return reflect.ValueOf(ptr).Elem().Interface().({{.OutType}})
+}
+
+// ptr returns t if it is a pointer, otherwise a pointer to a copy of it, as
+// msgp may generate methods with pointer receivers.
+func (m *{{.Recv}}) ptr(t {{.OutType}}) interface{} {
+	rv := reflect.ValueOf(t)
+	if rv.Kind() == reflect.Ptr {
+		return t
+	}
+	p := reflect.New(rv.Type())
+	p.Elem().Set(rv)
+	return p.Interface()
+}
+
+func (m *{{.Recv}}) DecodeMsg(dc *msgp.Reader) (t {{.OutType}}, err error) {
+	if dc.IsNil() {
+		err = dc.ReadNil()
+		return
+	}
+	{{- if .Unknown }}
+
+	// the whole value is read first so it can be kept if its ID is unknown
+	var raw msgp.Raw
+	if err = raw.DecodeMsg(dc); err != nil {
+		return
+	}
+	t, _, err = m.UnmarshalMsg(raw)
+	return
+	{{- else }}
+	{{- if ne .Layout "array" }}
+	var next msgp.Type
+	if next, err = dc.NextType(); err != nil {
+		return
+	}
+	if next != msgp.ArrayType {
+		var raw msgp.Raw
+		if err = raw.DecodeMsg(dc); err != nil {
+			return
+		}
+		t, err = m.unmarshalEnvelope(raw)
+		return
+	}
+	{{- end }}
+	var sz uint32
+	if sz, err = dc.ReadArrayHeader(); err != nil {
+		return
+	}
+	if sz != 2 {
+		err = msgp.ArrayError{Wanted: 2, Got: sz}
+		return
+	}
+
+	var i int64
+	{{- template "readTag" . }}
+
+	var ptr interface{}
+	if t, ptr, err = m.value(i); err != nil {
+		return
+	}
+	dec, ok := ptr.(msgp.Decodable)
+	if !ok {
+		err = fmt.Errorf("{{.OutType}}: %T does not implement msgp.Decodable", t)
+		return
+	}
+	if err = dec.DecodeMsg(dc); err != nil {
+		return
+	}
+	t = m.result(t, ptr)
+	return
+	{{- end }}
+}
+
+func (m *{{.Recv}}) UnmarshalMsg(bts []byte) (t {{.OutType}}, o []byte, err error) {
+	o = bts
+	if msgp.IsNil(bts) {
+		o, err = msgp.ReadNilBytes(o)
+		return
+	}
+	{{- if ne .Layout "array" }}
+	if msgp.NextType(o) != msgp.ArrayType {
+		if o, err = msgp.Skip(o); err != nil {
+			return
+		}
+		t, err = m.unmarshalEnvelope(bts[:len(bts)-len(o)])
+		return
+	}
+	{{- end }}
+	var sz uint32
+	if sz, o, err = msgp.ReadArrayHeaderBytes(o); err != nil {
+		return
+	}
+	if sz != 2 {
+		err = msgp.ArrayError{Wanted: 2, Got: sz}
+		return
+	}
+
+	var i int64
+	{{- template "readTagBytes" . }}
+
+	var ptr interface{}
+	if t, ptr, err = m.value(i); err != nil {
+		return
+	}
+	{{- if .Unknown }}
+	if ptr == nil {
+		if o, err = msgp.Skip(o); err != nil {
+			return
+		}
+		t = &{{.Unknown}}{ID: i, Raw: append(msgp.Raw(nil), bts[:len(bts)-len(o)]...)}
+		return
+	}
+	{{- end }}
+	u, ok := ptr.(msgp.Unmarshaler)
+	if !ok {
+		err = fmt.Errorf("{{.OutType}}: %T does not implement msgp.Unmarshaler", t)
+		return
+	}
+	if o, err = u.UnmarshalMsg(o); err != nil {
+		return
+	}
+	t = m.result(t, ptr)
+	return
+}
+
+func (m *{{.Recv}}) EncodeMsg(t {{.OutType}}, en *msgp.Writer) (err error) {
+	if t == nil {
+		return en.WriteNil()
+	}
+	{{- template "writeUnknown" . }}
+	var id int64
+	if id, err = m.id(t); err != nil {
+		return
+	}
+	enc, ok := m.ptr(t).(msgp.Encodable)
+	if !ok {
+		return fmt.Errorf("{{.OutType}}: %T does not implement msgp.Encodable", t)
+	}
+
+	{{- if eq .Layout "array" }}
+
+	// array header, size 2
+	if err = en.Append(0x92); err != nil {
+		return
+	}
+	{{- else }}
+
+	// map header, size 2, key "t"
+	if err = en.Append(0x82, 0xa1, 't'); err != nil {
+		return
+	}
+	{{- end }}
+	if err = en.Write{{.Disc.Method}}({{.OpenTag}}); err != nil {
+		return
+	}
+	{{- if ne .Layout "array" }}
+	// key "v"
+	if err = en.Append(0xa1, 'v'); err != nil {
+		return
+	}
+	{{- end }}
+	return enc.EncodeMsg(en)
+}
+
+func (m *{{.Recv}}) MarshalMsg(t {{.OutType}}, b []byte) (o []byte, err error) {
+	o = b
+	if t == nil {
+		o = msgp.AppendNil(o)
+		return
+	}
+	{{- template "appendUnknown" . }}
+	var id int64
+	if id, err = m.id(t); err != nil {
+		return
+	}
+	mar, ok := m.ptr(t).(msgp.Marshaler)
+	if !ok {
+		err = fmt.Errorf("{{.OutType}}: %T does not implement msgp.Marshaler", t)
+		return
+	}
+
+	{{- if eq .Layout "array" }}
+
+	// array header, size 2
+	o = append(o, 0x92)
+	{{- else }}
+
+	// map header, size 2, key "t"
+	o = append(o, 0x82, 0xa1, 't')
+	{{- end }}
+	o = msgp.Append{{.Disc.Method}}(o, {{.OpenTag}})
+	{{- if ne .Layout "array" }}
+	// key "v"
+	o = append(o, 0xa1, 'v')
+	{{- end }}
+	return mar.MarshalMsg(o)
+}
+
+{{- if ne .Layout "array" }}
+
+// unmarshalEnvelope decodes a value written in the {{.Layout}} layout.
+func (m *{{.Recv}}) unmarshalEnvelope(b []byte) (t {{.OutType}}, err error) {
+	var i int64
+	var v []byte
+	if i, v, err = m.readEnvelope(b); err != nil {
+		return
+	}
+	if v == nil {
+		err = fmt.Errorf("{{.OutType}}: envelope has no value")
+		return
+	}
+
+	var ptr interface{}
+	if t, ptr, err = m.value(i); err != nil {
+		return
+	}
+	{{- if .Unknown }}
+	if ptr == nil {
+		t = &{{.Unknown}}{ID: i, Raw: append(msgp.Raw(nil), b...)}
+		return
+	}
+	{{- end }}
+	u, ok := ptr.(msgp.Unmarshaler)
+	if !ok {
+		err = fmt.Errorf("{{.OutType}}: %T does not implement msgp.Unmarshaler", t)
+		return
+	}
+	if _, err = u.UnmarshalMsg(v); err != nil {
+		return
+	}
+	t = m.result(t, ptr)
+	return
+}
+
+{{- template "readEnvelope" . }}
+{{- end }}
+
+{{- if .Disc.Str }}
+
+{{- template "parseTag" . }}
+{{- end }}
+
+func (m *{{.Recv}}) Msgsize(t {{.OutType}}) int {
+	if t == nil {
+		return msgp.NilSize
+	}
+	{{- if .Unknown }}
+	if u, ok := t.(*{{.Unknown}}); ok {
+		return len(u.Raw)
+	}
+	{{- end }}
+	if sz, ok := m.ptr(t).(msgp.Sizer); ok {
+		return {{.OpenOverhead}} + sz.Msgsize()
+	}
+	return {{.OpenOverhead}} + msgp.GuessSize(t)
+}
+{{- end }}
+
+{{- define "unknownType" }}
+
+// {{.Unknown}} holds a {{.OutType}} whose ID was not known when it was decoded,
+// so it can be passed on. It is encoded exactly as it was read.
+//
+// The embedded {{.OutType}} is always nil. It is only there so {{.Unknown}}
+// implements {{.OutType}}; calling its methods panics.
+type {{.Unknown}} struct {
+	{{.OutType}}
+
+	// The ID that was read.
+	ID int64
+
+	// The whole encoded value, including the envelope and the ID.
+	Raw msgp.Raw
+}
+{{- end }}
+
+{{- define "openInit" }}
+
+func init() {
+	{{- range .Types }}
+	{{$.OpenPrefix}}Register{{$.Iface}}({{.ID}}, func() {{$.OutType}} { return {{if .Pointer}}&{{end}}{{.ImportName}}{} })
+	{{- end }}
+}
+{{- end }}
+
+{{- define "openIntercept" }}
+var {{.MapperVar}} = &{{.MapperType}}{}
+
+func {{.Interceptor}}() *{{.MapperType}} { return {{.MapperVar}} }
+
+// {{.MapperType}} uses the registry in the package that declares {{.OutType}}.
+type {{.MapperType}} struct {}
+
+func (m *{{.MapperType}}) DecodeMsg(dc *msgp.Reader) ({{.OutType}}, error) {
+	return {{.OpenPrefix}}Decode{{.Iface}}(dc)
+}
+
+func (m *{{.MapperType}}) UnmarshalMsg(bts []byte) ({{.OutType}}, []byte, error) {
+	return {{.OpenPrefix}}Unmarshal{{.Iface}}(bts)
+}
+
+func (m *{{.MapperType}}) EncodeMsg(t {{.OutType}}, en *msgp.Writer) error {
+	return {{.OpenPrefix}}Encode{{.Iface}}(t, en)
+}
+
+func (m *{{.MapperType}}) MarshalMsg(t {{.OutType}}, b []byte) ([]byte, error) {
+	return {{.OpenPrefix}}Marshal{{.Iface}}(t, b)
+}
+
+func (m *{{.MapperType}}) Msgsize(t {{.OutType}}) int {
+	return {{.OpenPrefix}}Msgsize{{.Iface}}(t)
+}
+
+{{- end }}
 `
@@ -1,8 +1,55 @@
 package msgpgen
 
+import (
+	"fmt"
+	"io"
+	"sync"
+)
+
+type LogLevel int
+
+const (
+	LogDebug LogLevel = iota
+	LogInfo
+	LogWarn
+	LogError
+)
+
+func (l LogLevel) String() string {
+	switch l {
+	case LogDebug:
+		return "debug"
+	case LogInfo:
+		return "info"
+	case LogWarn:
+		return "warn"
+	case LogError:
+		return "error"
+	default:
+		return fmt.Sprintf("level(%d)", int(l))
+	}
+}
+
 const (
 	LogTypeSet = "typeset"
 
+	// Decisions made by the extractor while walking the type queue.
+	LogExtract = "extract"
+
+	// Directives that were applied or added.
+	LogDirective = "directive"
+
+	// Output from, and progress of, msgp's generator.
+	LogMsgp = "msgp"
+
+	// Generated files being written, or left alone.
+	LogWrite = "write"
+)
+
+const (
+	// Log code for messages that don't need a more specific code.
+	LogGeneral = 0
+
 	// Log code indicating an error occurred in the types.Config.Error
 	// callback, but execution continued.
 	LogTypesConfigError = 1
@@ -13,11 +60,38 @@ const (
 )
 
 type Log interface {
-	Log(category string, code int, message string, args ...interface{})
+	Log(level LogLevel, category string, code int, message string, args ...interface{})
 }
 
-func wlog(log Log, category string, code int, message string, args ...interface{}) {
+func wlog(log Log, level LogLevel, category string, code int, message string, args ...interface{}) {
 	if log != nil {
-		log.Log(category, code, message, args...)
+		log.Log(level, category, code, message, args...)
 	}
 }
+
+// WriterLog writes each message at or above Level to W on its own line.
+// Warnings and errors are prefixed with their level.
+type WriterLog struct {
+	W     io.Writer
+	Level LogLevel
+
+	lock sync.Mutex
+}
+
+func NewWriterLog(w io.Writer, level LogLevel) *WriterLog {
+	return &WriterLog{W: w, Level: level}
+}
+
+func (w *WriterLog) Log(level LogLevel, category string, code int, message string, args ...interface{}) {
+	if level < w.Level {
+		return
+	}
+	msg := fmt.Sprintf(message, args...)
+	if level >= LogWarn {
+		msg = level.String() + ": " + msg
+	}
+
+	w.lock.Lock()
+	defer w.lock.Unlock()
+	fmt.Fprintln(w.W, msg)
+}
@@ -0,0 +1,333 @@
+package msgpgen
+
+import (
+	"fmt"
+	"sort"
+
+	"github.com/pkg/errors"
+	"github.com/shabbyrobe/structer"
+)
+
+// StateRenumber records a type that was given a new ID by MergeStates
+// because its ID collided with another type's. Data already written using
+// the old ID on that branch will no longer decode as the same type, and the
+// generated code must be regenerated.
+type StateRenumber struct {
+	Type structer.TypeName
+
+	// The interface whose ID space the type was renumbered in. Empty for the
+	// global space.
+	Iface structer.TypeName
+
+	From, To int
+}
+
+func (r StateRenumber) String() string {
+	s := fmt.Sprintf("%s renumbered from %d to %d", r.Type, r.From, r.To)
+	if r.Iface.Name != "" {
+		s += fmt.Sprintf(" [%s]", r.Iface)
+	}
+	return s
+}
+
+// MergeStates performs a three way merge of the state files from two
+// branches that share a common ancestor, for use as a git merge driver.
+//
+// IDs that both sides agree on are kept. IDs that existed in base are never
+// renumbered; if the two sides disagree about one, the merge fails. A type
+// retired on either side stays retired, and tombstones from both sides are
+// kept. Types added on both branches that claim the same ID are resolved
+// deterministically: the type whose name sorts first keeps the ID, and the
+// others are given new IDs in name order. A type added on both branches
+// with different IDs keeps the lower one, and the higher one is retired.
+// Every type that was given a new ID on either branch is returned so the
+// caller can tell the user to regenerate.
+//
+// The merged state replaces ours, and can be saved over the file ours was
+// loaded from.
+func MergeStates(base, ours, theirs *State) (*State, []StateRenumber, error) {
+	if ours.Namespaced != theirs.Namespaced {
+		return nil, nil, errors.Errorf("only one branch has a namespaced state; run 'msgpgen state namespace' on the other branch and merge again")
+	}
+
+	merged := &State{Namespaced: ours.Namespaced, New: ours.New, loaded: ours.loaded}
+	if err := merged.Init(); err != nil {
+		return nil, nil, err
+	}
+
+	var renumbered []StateRenumber
+
+	space, err := mergeSpace(structer.TypeName{}, &base.StateSpace, &ours.StateSpace, &theirs.StateSpace)
+	if err != nil {
+		return nil, nil, err
+	}
+	merged.StateSpace = *space.StateSpace
+	renumbered = append(renumbered, space.renumbered...)
+
+	ifaces := make(map[structer.TypeName]bool)
+	for iface := range ours.Ifaces {
+		ifaces[iface] = true
+	}
+	for iface := range theirs.Ifaces {
+		ifaces[iface] = true
+	}
+	for iface := range ifaces {
+		space, err := mergeSpace(iface, base.Ifaces[iface], ours.Ifaces[iface], theirs.Ifaces[iface])
+		if err != nil {
+			return nil, nil, errors.Wrapf(err, "interface %s", iface)
+		}
+		merged.Ifaces[iface] = space.StateSpace
+		renumbered = append(renumbered, space.renumbered...)
+	}
+
+	if err := merged.Init(); err != nil {
+		return nil, nil, errors.Wrap(err, "merged state is invalid")
+	}
+	sort.Slice(renumbered, func(i, j int) bool {
+		if renumbered[i].Iface != renumbered[j].Iface {
+			return renumbered[i].Iface.String() < renumbered[j].Iface.String()
+		}
+		if renumbered[i].Type != renumbered[j].Type {
+			return renumbered[i].Type.String() < renumbered[j].Type.String()
+		}
+		return renumbered[i].From < renumbered[j].From
+	})
+	return merged, renumbered, nil
+}
+
+type mergedSpace struct {
+	*StateSpace
+	renumbered []StateRenumber
+}
+
+func mergeSpace(iface structer.TypeName, base, ours, theirs *StateSpace) (*mergedSpace, error) {
+	for _, sp := range []**StateSpace{&base, &ours, &theirs} {
+		if *sp == nil {
+			*sp = &StateSpace{}
+			if err := (*sp).init(); err != nil {
+				return nil, err
+			}
+		}
+	}
+
+	out := &mergedSpace{StateSpace: &StateSpace{}}
+	if err := out.init(); err != nil {
+		return nil, err
+	}
+
+	// Tombstones from either side are kept; an ID retired anywhere is never
+	// handed out again.
+	retired := make(map[int]bool)
+	for _, sp := range []*StateSpace{base, ours, theirs} {
+		for _, r := range sp.Retired {
+			if !retired[r.ID] {
+				retired[r.ID] = true
+				out.Retired = append(out.Retired, r)
+			}
+		}
+	}
+
+	used := make(map[int]bool)
+	for id := range retired {
+		used[id] = true
+	}
+
+	// Types from base. Either side may have renamed or retired them, but
+	// their IDs must not change.
+	handled := make(map[structer.TypeName]bool)
+	for _, bn := range base.SortedNames() {
+		bst := base.Types[bn]
+		on, ost := findMergeEntry(ours, base, bn)
+		tn, tst := findMergeEntry(theirs, base, bn)
+		handled[on] = true
+		handled[tn] = true
+
+		if retired[bst.ID] {
+			continue
+		}
+		if ost == nil && tst == nil {
+			continue
+		}
+		if ost != nil && tst != nil {
+			if ost.ID != tst.ID {
+				return nil, errors.Errorf("%s had ID %d; one branch has it as %d and the other as %d", bn, bst.ID, ost.ID, tst.ID)
+			}
+			if on != bn && tn != bn && on != tn {
+				return nil, errors.Errorf("%s was renamed to %s on one branch and %s on the other", bn, on, tn)
+			}
+		}
+
+		// If either side renamed the type, the new name wins.
+		name, st := bn, mergeEntry(bst, ost, tst)
+		if ost != nil && on != bn {
+			name = on
+		} else if tst != nil && tn != bn {
+			name = tn
+		}
+		if used[st.ID] {
+			return nil, errors.Errorf("%s has ID %d, which the other branch gave to another type", name, st.ID)
+		}
+		used[st.ID] = true
+		out.Types[name] = st
+	}
+
+	// Types added on either branch. A type claims the ID it was given; if it
+	// was added on both branches with different IDs, it claims the lower and
+	// the higher is retired, as data may already have been written with it.
+	claims := make(map[int][]structer.TypeName)
+	added := make(map[structer.TypeName]*StateType)
+	dropped := make(map[structer.TypeName]int)
+	for _, sp := range []*StateSpace{ours, theirs} {
+		for _, name := range sp.SortedNames() {
+			if handled[name] {
+				continue
+			}
+			st := sp.Types[name]
+			if cur, ok := added[name]; ok {
+				merged := mergeEntry(nil, cur, st)
+				if st.ID != cur.ID {
+					merged.ID, dropped[name] = cur.ID, st.ID
+					if st.ID < cur.ID {
+						merged.ID, dropped[name] = st.ID, cur.ID
+					}
+				}
+				added[name] = merged
+			} else {
+				added[name] = mergeEntry(nil, st, nil)
+			}
+		}
+	}
+	for _, name := range sortedTypeNames(dropped) {
+		id := dropped[name]
+		if !retired[id] {
+			retired[id] = true
+			used[id] = true
+			out.Retired = append(out.Retired, RetiredID{
+				ID: id, Type: name.String(), Retired: stateNow().UTC().Format("2006-01-02"),
+			})
+		}
+	}
+	for name, st := range added {
+		claims[st.ID] = append(claims[st.ID], name)
+	}
+
+	var losers []structer.TypeName
+	for id, names := range claims {
+		sort.Slice(names, func(i, j int) bool {
+			return names[i].String() < names[j].String()
+		})
+		start := 0
+		if !used[id] {
+			used[id] = true
+			out.Types[names[0]] = added[names[0]]
+			start = 1
+		}
+		losers = append(losers, names[start:]...)
+	}
+
+	nextID := 1
+	for _, sp := range []*StateSpace{base, ours, theirs} {
+		if sp.NextID > nextID {
+			nextID = sp.NextID
+		}
+	}
+	for id := range used {
+		if id >= nextID {
+			nextID = id + 1
+		}
+	}
+
+	sort.Slice(losers, func(i, j int) bool {
+		return losers[i].String() < losers[j].String()
+	})
+	for _, name := range losers {
+		st := added[name]
+		out.renumbered = append(out.renumbered, StateRenumber{Type: name, Iface: iface, From: st.ID, To: nextID})
+		st.ID = nextID
+		used[nextID] = true
+		out.Types[name] = st
+		nextID++
+	}
+
+	for _, name := range sortedTypeNames(dropped) {
+		out.renumbered = append(out.renumbered, StateRenumber{
+			Type: name, Iface: iface, From: dropped[name], To: out.Types[name].ID,
+		})
+	}
+
+	out.NextID = nextID
+	return out, nil
+}
+
+func sortedTypeNames(m map[structer.TypeName]int) []structer.TypeName {
+	names := make([]structer.TypeName, 0, len(m))
+	for name := range m {
+		names = append(names, name)
+	}
+	sort.Slice(names, func(i, j int) bool {
+		return names[i].String() < names[j].String()
+	})
+	return names
+}
+
+// findMergeEntry finds the entry for a type from base in one side of the
+// merge, following a rename if the side recorded one in Formerly.
+func findMergeEntry(side, base *StateSpace, bn structer.TypeName) (structer.TypeName, *StateType) {
+	if st, ok := side.Types[bn]; ok {
+		return bn, st
+	}
+	for _, name := range side.SortedNames() {
+		if _, ok := base.Types[name]; ok {
+			continue
+		}
+		for _, f := range side.Types[name].Formerly {
+			if f == bn.String() {
+				return name, side.Types[name]
+			}
+		}
+	}
+	return structer.TypeName{}, nil
+}
+
+// mergeEntry combines the metadata of a type from both sides of a merge.
+// Either side may be nil. The ID is taken from whichever side is present,
+// preferring ours.
+func mergeEntry(base, ours, theirs *StateType) *StateType {
+	first := ours
+	if first == nil {
+		first = theirs
+	}
+	out := &StateType{ID: first.ID, Added: first.Added, Deprecated: first.Deprecated}
+	if base != nil {
+		out.Added = base.Added
+	}
+
+	if ours != nil && theirs != nil && ours.Deprecated != theirs.Deprecated {
+		// Whichever side changed the flag wins.
+		if base != nil && ours.Deprecated == base.Deprecated {
+			out.Deprecated = theirs.Deprecated
+		} else {
+			out.Deprecated = ours.Deprecated
+		}
+	}
+
+	seen := make(map[string]bool)
+	for _, st := range []*StateType{ours, theirs} {
+		if st == nil {
+			continue
+		}
+		for _, f := range st.Formerly {
+			if !seen[f] {
+				seen[f] = true
+				out.Formerly = append(out.Formerly, f)
+			}
+		}
+		for _, i := range st.Ifaces {
+			tn, err := structer.ParseTypeName(i)
+			if err == nil {
+				out.addIface(tn)
+			}
+		}
+	}
+	return out
+}
@@ -0,0 +1,166 @@
+package msgpgen
+
+import (
+	"encoding/json"
+	"reflect"
+	"sort"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/shabbyrobe/structer"
+)
+
+func testState(t *testing.T, src string) *State {
+	t.Helper()
+	state := &State{}
+	if err := json.Unmarshal([]byte(src), state); err != nil {
+		t.Fatal(err)
+	}
+	if err := state.Init(); err != nil {
+		t.Fatal(err)
+	}
+	return state
+}
+
+func stateIDs(space *StateSpace) map[string]int {
+	ids := make(map[string]int, len(space.Types))
+	for tn, st := range space.Types {
+		ids[tn.String()] = st.ID
+	}
+	return ids
+}
+
+func retiredIDs(space *StateSpace) []int {
+	ids := make([]int, 0, len(space.Retired))
+	for _, r := range space.Retired {
+		ids = append(ids, r.ID)
+	}
+	sort.Ints(ids)
+	return ids
+}
+
+func TestMergeStates(t *testing.T) {
+	defer func(now func() time.Time) { stateNow = now }(stateNow)
+	stateNow = func() time.Time { return time.Date(2020, 1, 2, 0, 0, 0, 0, time.UTC) }
+
+	for _, tc := range []struct {
+		name               string
+		base, ours, theirs string
+		ids                map[string]int
+		retired            []int
+		renumbered         []string
+		err                string
+	}{
+		{
+			name:   "agree",
+			base:   `{"Types": {"p.A": 1}}`,
+			ours:   `{"Types": {"p.A": 1, "p.B": 2}}`,
+			theirs: `{"Types": {"p.A": 1, "p.B": 2}}`,
+			ids:    map[string]int{"p.A": 1, "p.B": 2},
+		},
+		{
+			name:   "base-conflict",
+			base:   `{"Types": {"p.A": 1}}`,
+			ours:   `{"Types": {"p.A": 1}}`,
+			theirs: `{"Types": {"p.A": 3}}`,
+			err:    "p.A had ID 1",
+		},
+		{
+			name:       "new-collision",
+			base:       `{"Types": {"p.A": 1}}`,
+			ours:       `{"Types": {"p.A": 1, "p.B": 2}}`,
+			theirs:     `{"Types": {"p.A": 1, "p.C": 2}}`,
+			ids:        map[string]int{"p.A": 1, "p.B": 2, "p.C": 3},
+			renumbered: []string{"p.C renumbered from 2 to 3"},
+		},
+		{
+			name:       "same-type-different-ids",
+			base:       `{"Types": {"p.A": 1}}`,
+			ours:       `{"Types": {"p.A": 1, "p.B": 2}}`,
+			theirs:     `{"Types": {"p.A": 1, "p.B": 3}}`,
+			ids:        map[string]int{"p.A": 1, "p.B": 2},
+			retired:    []int{3},
+			renumbered: []string{"p.B renumbered from 3 to 2"},
+		},
+		{
+			name:    "same-type-different-ids-collision",
+			base:    `{"Types": {"p.A": 1}}`,
+			ours:    `{"Types": {"p.A": 1, "p.B": 2}}`,
+			theirs:  `{"Types": {"p.A": 1, "p.C": 2, "p.B": 3}}`,
+			ids:     map[string]int{"p.A": 1, "p.B": 2, "p.C": 4},
+			retired: []int{3},
+			renumbered: []string{
+				"p.B renumbered from 3 to 2",
+				"p.C renumbered from 2 to 4",
+			},
+		},
+		{
+			name:    "tombstones",
+			base:    `{"Types": {"p.A": 1, "p.B": 2, "p.C": 3}}`,
+			ours:    `{"Types": {"p.B": 2, "p.C": 3}, "Retired": [{"ID": 1, "Type": "p.A"}]}`,
+			theirs:  `{"Types": {"p.A": 1, "p.C": 3}, "Retired": [{"ID": 2, "Type": "p.B"}]}`,
+			ids:     map[string]int{"p.C": 3},
+			retired: []int{1, 2},
+		},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			merged, renumbered, err := MergeStates(testState(t, tc.base), testState(t, tc.ours), testState(t, tc.theirs))
+			if tc.err != "" {
+				if err == nil || !strings.Contains(err.Error(), tc.err) {
+					t.Fatalf("expected error containing %q, found %v", tc.err, err)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			if ids := stateIDs(&merged.StateSpace); !reflect.DeepEqual(ids, tc.ids) {
+				t.Fatalf("IDs: %v != %v", ids, tc.ids)
+			}
+			retired := retiredIDs(&merged.StateSpace)
+			if tc.retired == nil {
+				tc.retired = []int{}
+			}
+			if !reflect.DeepEqual(retired, tc.retired) {
+				t.Fatalf("retired: %v != %v", retired, tc.retired)
+			}
+			var msgs []string
+			for _, r := range renumbered {
+				msgs = append(msgs, r.String())
+			}
+			if !reflect.DeepEqual(msgs, tc.renumbered) {
+				t.Fatalf("renumbered: %q != %q", msgs, tc.renumbered)
+			}
+
+			// the merged state must never hand out an ID that was used on
+			// either branch
+			for _, sp := range []string{tc.base, tc.ours, tc.theirs} {
+				for _, st := range testState(t, sp).Types {
+					if merged.NextID <= st.ID {
+						t.Fatalf("NextID %d would reuse %d", merged.NextID, st.ID)
+					}
+				}
+			}
+		})
+	}
+}
+
+func TestMergeStatesNamespaced(t *testing.T) {
+	base := testState(t, `{"Namespaced": true, "Ifaces": {"p.I": {"Types": {"p.A": 1}}}}`)
+	ours := testState(t, `{"Namespaced": true, "Ifaces": {"p.I": {"Types": {"p.A": 1, "p.B": 2}}}}`)
+	theirs := testState(t, `{"Namespaced": true, "Ifaces": {"p.I": {"Types": {"p.A": 1, "p.C": 2}}}}`)
+
+	merged, renumbered, err := MergeStates(base, ours, theirs)
+	if err != nil {
+		t.Fatal(err)
+	}
+	iface := structer.TypeName{PackagePath: "p", Name: "I"}
+	if ids := stateIDs(merged.Ifaces[iface]); !reflect.DeepEqual(ids, map[string]int{"p.A": 1, "p.B": 2, "p.C": 3}) {
+		t.Fatal(ids)
+	}
+	if len(renumbered) != 1 || renumbered[0].Iface != iface {
+		t.Fatal(renumbered)
+	}
+}
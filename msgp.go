@@ -135,7 +135,7 @@ var ptnIgnoredField = regexp.MustCompile(`: ignored\.`)
 
 // msgp's generator emits an "unresolved identifier" warning or a "non-local
 // identifier" warning even if we specify a type has an explicit "msgp:ignore"
-// or "msgp:shim" directive
+// or "msgp:shim" directive, either in the package or globally
 func isIgnoredUnresolved(tpset *structer.TypePackageSet, dctvs *Directives, seen map[string]bool, line string) bool {
 	m := ptnUnresolvedIdentifier.FindStringSubmatch(line)
 	if len(m) == 2 {
@@ -153,6 +153,16 @@ func isIgnoredUnresolved(tpset *structer.TypePackageSet, dctvs *Directives, seen
 				return true
 			}
 		}
+		// global ignores are not declared in the package, so msgp reports
+		// them by the name the package refers to them with.
+		if dctvs.global != nil {
+			for tn := range dctvs.global.ignore {
+				ln, err := tpset.LocalImportName(tn, dctvs.pkg)
+				if err == nil && unresolved == ln {
+					return true
+				}
+			}
+		}
 		return false
 	}
 
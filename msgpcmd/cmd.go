@@ -5,12 +5,14 @@ import (
 	"bytes"
 	"flag"
 	"go/types"
+	"io"
 	"os/exec"
 	"strings"
 
 	"github.com/pkg/errors"
 	"github.com/shabbyrobe/msgpgen"
 	"github.com/shabbyrobe/structer"
+	"golang.org/x/tools/go/packages"
 )
 
 type StringList []string
@@ -28,6 +30,42 @@ type LoaderConfig struct {
 	Interfaces StringList
 	State      string
 	Imports    StringList
+	Scope      StringList
+	TypesFile  string
+	Report     string
+	Graph      string
+
+	// Project file to load; if empty, msgpgen.json is searched for in the
+	// working directory and its parents unless NoProjectFile is set.
+	ProjectFile   string
+	NoProjectFile bool
+
+	// Shim and ignore directives that apply to every package. These can only
+	// come from the project file.
+	Directives []string
+}
+
+type LogConfig struct {
+	Verbose bool
+	Quiet   bool
+}
+
+// Log returns a log that writes to w at the level selected by the flags:
+// debug with -v, warnings and errors only with -q, info otherwise.
+func (l LogConfig) Log(w io.Writer) msgpgen.Log {
+	level := msgpgen.LogInfo
+	if l.Verbose {
+		level = msgpgen.LogDebug
+	} else if l.Quiet {
+		level = msgpgen.LogWarn
+	}
+	return msgpgen.NewWriterLog(w, level)
+}
+
+func LogFlags(fs *flag.FlagSet, log *LogConfig) error {
+	fs.BoolVar(&log.Verbose, "v", false, "Verbose output; log every extraction decision and all msgp output")
+	fs.BoolVar(&log.Quiet, "q", false, "Quiet output; only log warnings and errors")
+	return nil
 }
 
 func ConfigFlags(fs *flag.FlagSet, config *msgpgen.Config) error {
@@ -35,21 +73,45 @@ func ConfigFlags(fs *flag.FlagSet, config *msgpgen.Config) error {
 	fs.BoolVar(&config.GenMarshal, "marshal", config.GenMarshal, "create Encode and Decode methods")
 	fs.BoolVar(&config.GenTests, "tests", config.GenTests, "create tests and benchmarks")
 	fs.BoolVar(&config.GenVersion, "ver", config.GenVersion, "generate version files")
+	fs.BoolVar(&config.GenTypeIDs, "typeids", config.GenTypeIDs, "create a registry of type IDs for each intercepted interface")
 	fs.BoolVar(&config.Unexported, "unexported", config.Unexported, "also process unexported types")
 	fs.BoolVar(&config.KeepTemp, "keep", config.KeepTemp, "Keep temp files used by generator")
 	fs.StringVar(&config.TempDirName, "tempdir", config.TempDirName, "Name of the temp dir used by the generator.")
 	fs.StringVar(&config.FileTemplate, "filetpl", config.FileTemplate, "Template of generated file name")
 	fs.StringVar(&config.TestTemplate, "testtpl", config.TestTemplate, "Template of generated test file name")
+	fs.BoolVar(&config.Check, "check", config.Check, "Write nothing; fail if any generated file or the state file is out of date")
+	fs.BoolVar(&config.Diff, "diff", config.Diff, "With -check, print a unified diff of each out of date file")
+	fs.StringVar((*string)(&config.IDStrategy), "ids", string(config.IDStrategy), "How interface implementers get their IDs: 'state' assigns them in the -state file, 'hash' derives them from the type name")
+	fs.StringVar((*string)(&config.Discriminator), "discriminator", string(config.Discriminator), "How the type of each intercepted interface value is written: 'string' or 'int' ID, or the type's 'name'")
+	fs.StringVar((*string)(&config.Envelope), "envelope", string(config.Envelope), "Layout of each intercepted interface value: 'array' [t, v], 'map' {t, v}, or 'flat' with t added to the value's map")
+	fs.BoolVar(&config.StrictState, "strict-state", config.StrictState, "Fail if the state file has entries for types that are missing or no longer implement an intercepted interface, or implementers without an ID")
 	return nil
 }
 
 func LoaderFlags(fs *flag.FlagSet, loader *LoaderConfig) error {
 	fs.StringVar(&loader.State, "state", "", "State file for mapping polymorphic types")
+	fs.StringVar(&loader.Graph, "graph", "", "Write the graph of discovered types to this file. The format is chosen by the extension: .dot or .json")
+	fs.StringVar(&loader.Report, "report", "", "Write a JSON record of every extraction decision to this file")
+	fs.StringVar(&loader.TypesFile, "types-file", "", "File containing fully qualified type names to generate, one per line. Supports '#' comments and glob patterns.")
+	fs.StringVar(&loader.ProjectFile, "config", "", "Project file to load. Defaults to the nearest "+ProjectFileName+" in the working directory or its parents.")
+	fs.BoolVar(&loader.NoProjectFile, "noconfig", false, "Do not load a project file")
 	fs.Var(&loader.Interfaces, "ifaces", "Search for types that implement this interface for generation. Comma separated list.")
-	fs.Var(&loader.Imports, "import", "Import these packages to search for types. Comma separated list. Uses go list.")
+	fs.Var(&loader.Imports, "import", "Import these packages to search for types. Comma separated list. Uses go/packages, so module paths are supported.")
+	fs.Var(&loader.Scope, "scope", "Also allow generated output in packages matching this import path pattern. The -import packages are always allowed. Can be passed multiple times.")
 	return nil
 }
 
+// ScopeFromPackages returns the generation scope for msgpgen.Config.Scope:
+// the import paths of the loaded packages plus the loader's extra -scope
+// patterns.
+func ScopeFromPackages(loader LoaderConfig, pkgs []*packages.Package) []string {
+	var scope []string
+	for _, pkg := range pkgs {
+		scope = append(scope, pkg.PkgPath)
+	}
+	return append(scope, loader.Scope...)
+}
+
 func FindIfaces(tpset *structer.TypePackageSet, ifaces ...structer.TypeName) ([]structer.TypeName, error) {
 	var allNamed []*types.Named
 	var ifaceNamed *types.Named
@@ -106,6 +168,10 @@ func FindIfaces(tpset *structer.TypePackageSet, ifaces ...structer.TypeName) ([]
 	return ts, nil
 }
 
+// GoList expands the package patterns using 'go list'.
+//
+// Deprecated: the import paths it returns are resolved against the GOPATH by
+// structer.TypePackageSet.Import. Use LoadPackages instead.
 func GoList(pkgs []string) ([]string, error) {
 	var l []string
 	var args = []string{"list"}
@@ -0,0 +1,123 @@
+package msgpcmd
+
+import (
+	"fmt"
+	"go/types"
+	"path/filepath"
+	"strings"
+
+	"github.com/pkg/errors"
+	"github.com/shabbyrobe/structer"
+	"golang.org/x/tools/go/packages"
+)
+
+const packagesLoadMode = packages.NeedName | packages.NeedFiles
+
+// importPackage relies on the set resolving imports from a directory.
+var _ types.ImporterFrom = (*structer.TypePackageSet)(nil)
+
+// LoadPackages resolves the import patterns using golang.org/x/tools/go/packages,
+// which understands go.mod, replace directives and the module cache, then
+// imports each matching package into the type package set.
+//
+// The returned packages are in the order go/packages returned them. Type
+// errors in the packages are ignored, but a package that could not be
+// imported at all is an error.
+func LoadPackages(tpset *structer.TypePackageSet, patterns []string) ([]*packages.Package, error) {
+	pkgs, err := ListPackages(patterns)
+	if err != nil {
+		return nil, err
+	}
+
+	var msgs []string
+	for _, pkg := range pkgs {
+		// type errors are tolerated - the import raises them for any type
+		// resolution errors at all, which we don't necessarily care about;
+		// we may have incomplete types that won't be complete until the
+		// generator runs! only a package that could not be imported at all
+		// is an error.
+		if tpkg, err := importPackage(tpset, pkg); err != nil && tpkg == nil {
+			msgs = append(msgs, fmt.Sprintf("%s: %v", pkg.PkgPath, err))
+		}
+	}
+	if len(msgs) > 0 {
+		return nil, errors.Errorf("could not import packages:\n%s", strings.Join(msgs, "\n"))
+	}
+
+	return pkgs, nil
+}
+
+// ListPackages resolves the import patterns using go/packages without
+// importing them.
+func ListPackages(patterns []string) ([]*packages.Package, error) {
+	if len(patterns) == 0 {
+		return nil, nil
+	}
+
+	cfg := &packages.Config{Mode: packagesLoadMode}
+	pkgs, err := packages.Load(cfg, patterns...)
+	if err != nil {
+		return nil, errors.Wrapf(err, "could not load packages %s", strings.Join(patterns, ","))
+	}
+
+	var lerr *PackagesError
+	for _, pkg := range pkgs {
+		for _, perr := range pkg.Errors {
+			// Type errors are tolerated for the same reason LoadPackages
+			// ignores import errors; we only care about packages we can't
+			// find.
+			if perr.Kind == packages.ListError {
+				if lerr == nil {
+					lerr = &PackagesError{Failed: make(map[string][]string)}
+				}
+				if _, ok := lerr.Failed[pkg.PkgPath]; !ok {
+					lerr.Paths = append(lerr.Paths, pkg.PkgPath)
+				}
+				lerr.Failed[pkg.PkgPath] = append(lerr.Failed[pkg.PkgPath], perr.Error())
+			}
+		}
+	}
+	if lerr != nil {
+		return nil, lerr
+	}
+	return pkgs, nil
+}
+
+// PackagesError is returned by ListPackages and LoadPackages if any of the
+// packages could not be found.
+type PackagesError struct {
+	// Import paths of the packages that failed, in the order go/packages
+	// returned them.
+	Paths []string
+
+	// Errors reported for each package in Paths.
+	Failed map[string][]string
+}
+
+func (p *PackagesError) Error() string {
+	var msgs []string
+	for _, path := range p.Paths {
+		msgs = append(msgs, p.Failed[path]...)
+	}
+	return fmt.Sprintf("could not load packages:\n%s", strings.Join(msgs, "\n"))
+}
+
+// PackageDir returns the directory containing the package's source files.
+func PackageDir(pkg *packages.Package) string {
+	for _, files := range [][]string{pkg.GoFiles, pkg.OtherFiles, pkg.IgnoredFiles} {
+		if len(files) > 0 {
+			return filepath.Dir(files[0])
+		}
+	}
+	return ""
+}
+
+// importPackage imports the package from its resolved source directory so
+// the type package set finds the module's copy rather than searching the
+// GOPATH for the bare import path.
+func importPackage(tpset *structer.TypePackageSet, pkg *packages.Package) (*types.Package, error) {
+	if dir := PackageDir(pkg); dir != "" {
+		return tpset.ImportFrom(pkg.PkgPath, dir, 0)
+	}
+	return tpset.Import(pkg.PkgPath)
+}
@@ -0,0 +1,234 @@
+package msgpcmd
+
+import (
+	"encoding/json"
+	"flag"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/pkg/errors"
+	"github.com/shabbyrobe/msgpgen"
+)
+
+const ProjectFileName = "msgpgen.json"
+
+// Project is the contents of a msgpgen.json project file. It allows every
+// //go:generate line in a repository to share one set of options. Keys are
+// named after the equivalent command line flags, and flags passed on the
+// command line override values in the file.
+//
+// Relative paths in the file, including relative -import patterns, are
+// resolved against the directory containing the file.
+type Project struct {
+	IO            *bool   `json:"io"`
+	Marshal       *bool   `json:"marshal"`
+	Tests         *bool   `json:"tests"`
+	Ver           *bool   `json:"ver"`
+	Unexported    *bool   `json:"unexported"`
+	AllowExtra    *bool   `json:"allowextra"`
+	TempDir       *string `json:"tempdir"`
+	FileTpl       *string `json:"filetpl"`
+	TestTpl       *string `json:"testtpl"`
+	VersionTpl    *string `json:"vertpl"`
+	StrictState   *bool   `json:"strict-state"`
+	TypeIDs       *bool   `json:"typeids"`
+	IDs           *string `json:"ids"`
+	Discriminator *string `json:"discriminator"`
+	Envelope      *string `json:"envelope"`
+
+	Ifaces    []string `json:"ifaces"`
+	Imports   []string `json:"import"`
+	Scope     []string `json:"scope"`
+	State     string   `json:"state"`
+	TypesFile string   `json:"types-file"`
+
+	// Shim and ignore directives that apply to every package, written as
+	// they would be in the source, i.e. "ignore github.com/foo/bar.Baz".
+	// Types must be fully qualified.
+	Directives []string `json:"directives"`
+
+	path string
+}
+
+// FindProjectFile walks up from dir looking for a msgpgen.json file. It
+// returns an empty string if there isn't one.
+func FindProjectFile(dir string) (string, error) {
+	dir, err := filepath.Abs(dir)
+	if err != nil {
+		return "", err
+	}
+	for {
+		file := filepath.Join(dir, ProjectFileName)
+		if _, err := os.Stat(file); err == nil {
+			return file, nil
+		} else if !os.IsNotExist(err) {
+			return "", err
+		}
+		parent := filepath.Dir(dir)
+		if parent == dir {
+			return "", nil
+		}
+		dir = parent
+	}
+}
+
+func LoadProjectFile(file string) (project *Project, rerr error) {
+	f, err := os.Open(file)
+	if err != nil {
+		return nil, err
+	}
+	defer func() {
+		if cerr := f.Close(); cerr != nil && rerr == nil {
+			rerr = cerr
+		}
+	}()
+
+	project = &Project{}
+	dec := json.NewDecoder(f)
+	dec.DisallowUnknownFields()
+	if err := dec.Decode(project); err != nil {
+		return nil, errors.Wrapf(err, "could not read project file %s", file)
+	}
+	if project.path, err = filepath.Abs(file); err != nil {
+		return nil, err
+	}
+	return project, nil
+}
+
+// ApplyProject loads the project file selected by the loader's -config and
+// -noconfig flags, or found by walking up from the working directory, and
+// copies its values into config and loader for every flag that was not set
+// on the command line. fs must already have been parsed.
+func ApplyProject(fs *flag.FlagSet, config *msgpgen.Config, loader *LoaderConfig) error {
+	if loader.NoProjectFile {
+		return nil
+	}
+
+	file := loader.ProjectFile
+	if file == "" {
+		wd, err := os.Getwd()
+		if err != nil {
+			return err
+		}
+		if file, err = FindProjectFile(wd); err != nil {
+			return err
+		}
+		if file == "" {
+			return nil
+		}
+	}
+
+	project, err := LoadProjectFile(file)
+	if err != nil {
+		return err
+	}
+	return project.Apply(fs, config, loader)
+}
+
+func (p *Project) Apply(fs *flag.FlagSet, config *msgpgen.Config, loader *LoaderConfig) error {
+	set := make(map[string]bool)
+	fs.Visit(func(f *flag.Flag) { set[f.Name] = true })
+
+	applyBool := func(name string, dest *bool, v *bool) {
+		if v != nil && !set[name] {
+			*dest = *v
+		}
+	}
+	applyString := func(name string, dest *string, v *string) {
+		if v != nil && !set[name] {
+			*dest = *v
+		}
+	}
+
+	applyBool("io", &config.GenIO, p.IO)
+	applyBool("marshal", &config.GenMarshal, p.Marshal)
+	applyBool("tests", &config.GenTests, p.Tests)
+	applyBool("ver", &config.GenVersion, p.Ver)
+	applyBool("unexported", &config.Unexported, p.Unexported)
+	applyBool("allowextra", &config.AllowExtra, p.AllowExtra)
+	applyBool("strict-state", &config.StrictState, p.StrictState)
+	applyBool("typeids", &config.GenTypeIDs, p.TypeIDs)
+	applyString("ids", (*string)(&config.IDStrategy), p.IDs)
+	applyString("discriminator", (*string)(&config.Discriminator), p.Discriminator)
+	applyString("envelope", (*string)(&config.Envelope), p.Envelope)
+	applyString("tempdir", &config.TempDirName, p.TempDir)
+	applyString("filetpl", &config.FileTemplate, p.FileTpl)
+	applyString("testtpl", &config.TestTemplate, p.TestTpl)
+	applyString("vertpl", &config.VersionFileTemplate, p.VersionTpl)
+
+	if len(p.Ifaces) > 0 && !set["ifaces"] {
+		loader.Interfaces = append(StringList{}, p.Ifaces...)
+	}
+	if len(p.Imports) > 0 && !set["import"] {
+		loader.Imports = loader.Imports[:0]
+		for _, imp := range p.Imports {
+			loader.Imports = append(loader.Imports, p.resolvePattern(imp))
+		}
+	}
+	if len(p.Scope) > 0 && !set["scope"] {
+		loader.Scope = append(StringList{}, p.Scope...)
+	}
+	if p.State != "" && !set["state"] {
+		loader.State = p.resolvePath(p.State)
+	}
+	if p.TypesFile != "" && !set["types-file"] {
+		loader.TypesFile = p.resolvePath(p.TypesFile)
+	}
+
+	for _, d := range p.Directives {
+		if _, err := ParseGlobalDirective(d); err != nil {
+			return errors.Wrapf(err, "project file %s", p.path)
+		}
+	}
+	loader.Directives = append(loader.Directives, p.Directives...)
+
+	return nil
+}
+
+func (p *Project) resolvePath(path string) string {
+	if filepath.IsAbs(path) {
+		return path
+	}
+	return filepath.Join(filepath.Dir(p.path), path)
+}
+
+// resolvePattern makes relative package patterns like ./... relative to the
+// project file. Import paths are left alone.
+func (p *Project) resolvePattern(pattern string) string {
+	if pattern == "." || pattern == ".." || strings.HasPrefix(pattern, "./") || strings.HasPrefix(pattern, "../") {
+		return p.resolvePath(pattern)
+	}
+	return pattern
+}
+
+// ParseGlobalDirective parses a directive that applies to every package.
+// Only shim and ignore directives are supported. The //msgp: prefix is
+// optional.
+func ParseGlobalDirective(line string) (msgpgen.Directive, error) {
+	dir, err := msgpgen.ParseDirective(strings.TrimPrefix(strings.TrimSpace(line), "//msgp:"))
+	if err != nil {
+		return nil, errors.Wrapf(err, "invalid directive %q", line)
+	}
+	switch dir.(type) {
+	case *msgpgen.ShimDirective, *msgpgen.IgnoreDirective:
+		return dir, nil
+	default:
+		return nil, errors.Errorf("directive %q cannot be applied globally; only shim and ignore are supported", line)
+	}
+}
+
+// AddGlobalDirectives parses the loader's global directives and adds them to
+// the cache.
+func AddGlobalDirectives(dctvCache *msgpgen.DirectivesCache, loader LoaderConfig) error {
+	for _, line := range loader.Directives {
+		dir, err := ParseGlobalDirective(line)
+		if err != nil {
+			return err
+		}
+		if err := dctvCache.AddGlobal(dir); err != nil {
+			return errors.Wrapf(err, "invalid directive %q", line)
+		}
+	}
+	return nil
+}
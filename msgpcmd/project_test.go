@@ -0,0 +1,43 @@
+package msgpcmd
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/shabbyrobe/msgpgen"
+	"github.com/shabbyrobe/structer"
+)
+
+func TestAddGlobalDirectives(t *testing.T) {
+	for _, tc := range []struct {
+		directive string
+		err       string
+	}{
+		{directive: "shim example.com/stamp.Stamp as:int64 using:ToInt64/FromInt64"},
+		{directive: "//msgp:ignore example.com/pkg.Token example.com/pkg.Other"},
+		{
+			directive: "shim Stamp as:int64 using:ToInt64/FromInt64",
+			err:       "must include the full package path",
+		},
+		{
+			directive: "shim example.com/stamp.Stamp as:int64 using:stamp.ToInt64/FromInt64",
+			err:       "must be a plain function name",
+		},
+		{
+			directive: "tuple example.com/pkg.Token",
+			err:       "cannot be applied globally",
+		},
+	} {
+		t.Run(tc.directive, func(t *testing.T) {
+			dctvCache := msgpgen.NewDirectivesCache(structer.NewTypePackageSet())
+			err := AddGlobalDirectives(dctvCache, LoaderConfig{Directives: []string{tc.directive}})
+			if tc.err == "" {
+				if err != nil {
+					t.Fatal(err)
+				}
+			} else if err == nil || !strings.Contains(err.Error(), tc.err) {
+				t.Fatalf("expected error containing %q, found %v", tc.err, err)
+			}
+		})
+	}
+}
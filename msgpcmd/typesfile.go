@@ -0,0 +1,206 @@
+package msgpcmd
+
+import (
+	"bufio"
+	"fmt"
+	"go/types"
+	"os"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/pkg/errors"
+	"github.com/shabbyrobe/structer"
+)
+
+type typesFileEntry struct {
+	line    int
+	pattern string
+}
+
+// LoadTypesFile reads a flat file containing a whitelist of fully qualified
+// type names, one per line, i.e:
+//
+//	# Comments start with a hash
+//	github.com/foo/mypkg.Event
+//	github.com/foo/mypkg/...Event*   # glob
+//
+// Glob patterns may use "*" and "?", which do not match "/" or ".", and "...",
+// which matches anything. Globs are matched against the named types in the
+// packages that have already been loaded into the set, so the packages they
+// refer to should be passed to -import. Exact names are imported if needed.
+//
+// Every entry must resolve to at least one type or an error that includes the
+// line number is returned.
+func LoadTypesFile(tpset *structer.TypePackageSet, file string) ([]structer.TypeName, error) {
+	entries, err := readTypesFile(file)
+	if err != nil {
+		return nil, err
+	}
+
+	// Load the packages of all the exact names in one pass; go/packages is
+	// expensive to start. The lines each package was named on are kept so a
+	// package that can't be found can be traced back to the file.
+	var pkgs []string
+	var pkgLines = make(map[string][]int)
+	for _, entry := range entries {
+		if isTypeGlob(entry.pattern) {
+			continue
+		}
+		tn, err := structer.ParseTypeName(entry.pattern)
+		if err != nil {
+			return nil, errors.Wrapf(err, "%s:%d: invalid type name %q", file, entry.line, entry.pattern)
+		}
+		if _, ok := tpset.TypePackages[tn.PackagePath]; ok {
+			continue
+		}
+		if _, ok := pkgLines[tn.PackagePath]; !ok {
+			pkgs = append(pkgs, tn.PackagePath)
+		}
+		pkgLines[tn.PackagePath] = append(pkgLines[tn.PackagePath], entry.line)
+	}
+	if _, err := LoadPackages(tpset, pkgs); err != nil {
+		if perr, ok := err.(*PackagesError); ok {
+			var msgs []string
+			for _, path := range perr.Paths {
+				pos := file
+				for i, line := range pkgLines[path] {
+					sep := ","
+					if i == 0 {
+						sep = ":"
+					}
+					pos += sep + strconv.Itoa(line)
+				}
+				msgs = append(msgs, fmt.Sprintf("%s: could not load package %s: %s",
+					pos, path, strings.Join(perr.Failed[path], "; ")))
+			}
+			return nil, errors.New(strings.Join(msgs, "\n"))
+		}
+		return nil, errors.Wrapf(err, "%s: could not load packages", file)
+	}
+
+	var out []structer.TypeName
+	var seen = make(map[structer.TypeName]bool)
+	for _, entry := range entries {
+		var found []structer.TypeName
+		if isTypeGlob(entry.pattern) {
+			if found, err = globTypes(tpset, entry.pattern); err != nil {
+				return nil, errors.Wrapf(err, "%s:%d", file, entry.line)
+			}
+			if len(found) == 0 {
+				return nil, errors.Errorf("%s:%d: pattern %q did not match any types", file, entry.line, entry.pattern)
+			}
+		} else {
+			tn, _ := structer.ParseTypeName(entry.pattern)
+			if tpset.FindObject(tn) == nil {
+				return nil, errors.Errorf("%s:%d: type %s not found", file, entry.line, tn)
+			}
+			found = []structer.TypeName{tn}
+		}
+
+		for _, tn := range found {
+			if !seen[tn] {
+				seen[tn] = true
+				out = append(out, tn)
+			}
+		}
+	}
+
+	return out, nil
+}
+
+func readTypesFile(file string) (entries []typesFileEntry, rerr error) {
+	f, err := os.Open(file)
+	if err != nil {
+		return nil, err
+	}
+	defer func() {
+		if cerr := f.Close(); cerr != nil && rerr == nil {
+			rerr = cerr
+		}
+	}()
+
+	scanner := bufio.NewScanner(f)
+	line := 0
+	for scanner.Scan() {
+		line++
+		text := scanner.Text()
+		if idx := strings.Index(text, "#"); idx >= 0 {
+			text = text[:idx]
+		}
+		text = strings.TrimSpace(text)
+		if len(text) == 0 {
+			continue
+		}
+		if strings.ContainsAny(text, " \t") {
+			return nil, errors.Errorf("%s:%d: expected one type per line, found %q", file, line, text)
+		}
+		entries = append(entries, typesFileEntry{line: line, pattern: text})
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+	return entries, nil
+}
+
+func isTypeGlob(pattern string) bool {
+	return strings.ContainsAny(pattern, "*?") || strings.Contains(pattern, "...")
+}
+
+func typeGlobPattern(pattern string) (*regexp.Regexp, error) {
+	var re strings.Builder
+	re.WriteString("^")
+	for i := 0; i < len(pattern); i++ {
+		switch {
+		case strings.HasPrefix(pattern[i:], "..."):
+			re.WriteString(".*")
+			i += 2
+		case pattern[i] == '*':
+			re.WriteString(`[^/.]*`)
+		case pattern[i] == '?':
+			re.WriteString(`[^/.]`)
+		default:
+			re.WriteString(regexp.QuoteMeta(pattern[i : i+1]))
+		}
+	}
+	re.WriteString("$")
+	return regexp.Compile(re.String())
+}
+
+// globTypes finds all named, non-interface types in the loaded packages
+// that match the pattern.
+func globTypes(tpset *structer.TypePackageSet, pattern string) ([]structer.TypeName, error) {
+	re, err := typeGlobPattern(pattern)
+	if err != nil {
+		return nil, errors.Wrapf(err, "invalid pattern %q", pattern)
+	}
+
+	var found []structer.TypeName
+	for _, pkg := range tpset.TypePackages {
+		// "no buildable Go source files" == nil pkg.
+		if pkg == nil {
+			continue
+		}
+		for _, name := range pkg.Scope().Names() {
+			obj, ok := pkg.Scope().Lookup(name).(*types.TypeName)
+			if !ok || types.IsInterface(obj.Type()) {
+				continue
+			}
+			nn, ok := obj.Type().(*types.Named)
+			if !ok || !re.MatchString(nn.String()) {
+				continue
+			}
+			tn, err := structer.ParseTypeName(nn.String())
+			if err != nil {
+				return nil, errors.Wrapf(err, "could not parse found type name %s", nn)
+			}
+			found = append(found, tn)
+		}
+	}
+
+	sort.Slice(found, func(i, j int) bool {
+		return found[i].String() < found[j].String()
+	})
+	return found, nil
+}
@@ -0,0 +1,94 @@
+package msgpcmd
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+)
+
+func TestTypeGlobPattern(t *testing.T) {
+	for _, tc := range []struct {
+		pattern string
+		match   []string
+		nomatch []string
+	}{
+		{
+			pattern: "github.com/foo/mypkg.Event*",
+			match:   []string{"github.com/foo/mypkg.Event", "github.com/foo/mypkg.EventCreated"},
+			nomatch: []string{"github.com/foo/mypkg.MyEvent", "github.com/foo/mypkg/sub.Event", "github.com/fooXmypkg.Event"},
+		},
+		{
+			pattern: "github.com/foo/*.Event",
+			match:   []string{"github.com/foo/mypkg.Event"},
+			nomatch: []string{"github.com/foo/mypkg/sub.Event", "github.com/foo/my.pkg.Event"},
+		},
+		{
+			pattern: "github.com/foo/mypkg.Event?",
+			match:   []string{"github.com/foo/mypkg.EventA"},
+			nomatch: []string{"github.com/foo/mypkg.Event", "github.com/foo/mypkg.EventAB"},
+		},
+		{
+			pattern: "github.com/foo/...Event*",
+			match:   []string{"github.com/foo/mypkg.Event", "github.com/foo/a/b/c.EventX", "github.com/foo/mypkg.MyEvent"},
+			nomatch: []string{"github.com/bar/mypkg.Event", "github.com/foo/mypkg.Other"},
+		},
+	} {
+		t.Run(tc.pattern, func(t *testing.T) {
+			if !isTypeGlob(tc.pattern) {
+				t.Fatalf("%q not detected as a glob", tc.pattern)
+			}
+			re, err := typeGlobPattern(tc.pattern)
+			if err != nil {
+				t.Fatal(err)
+			}
+			for _, s := range tc.match {
+				if !re.MatchString(s) {
+					t.Errorf("%q should match %q", tc.pattern, s)
+				}
+			}
+			for _, s := range tc.nomatch {
+				if re.MatchString(s) {
+					t.Errorf("%q should not match %q", tc.pattern, s)
+				}
+			}
+		})
+	}
+
+	if isTypeGlob("github.com/foo/mypkg.Event") {
+		t.Fatal("exact name detected as a glob")
+	}
+}
+
+func TestReadTypesFile(t *testing.T) {
+	dir, err := ioutil.TempDir("", "msgpgen-typesfile-")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	file := filepath.Join(dir, "types")
+	src := "# comment\n\ngithub.com/foo/mypkg.Event\n  github.com/foo/...Event*   # glob\n"
+	if err := ioutil.WriteFile(file, []byte(src), 0644); err != nil {
+		t.Fatal(err)
+	}
+	entries, err := readTypesFile(file)
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := []typesFileEntry{
+		{line: 3, pattern: "github.com/foo/mypkg.Event"},
+		{line: 4, pattern: "github.com/foo/...Event*"},
+	}
+	if !reflect.DeepEqual(entries, expected) {
+		t.Fatalf("%+v != %+v", entries, expected)
+	}
+
+	if err := ioutil.WriteFile(file, []byte("a.B\na.C a.D\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := readTypesFile(file); err == nil {
+		t.Fatal("expected an error for two types on one line")
+	}
+}
@@ -0,0 +1,14 @@
+package main
+
+func cmdCheck(args []string) error {
+	opts := newOptions()
+	fs, err := opts.flags("check")
+	if err != nil {
+		return err
+	}
+	if err := opts.parse(fs, args); err != nil {
+		return err
+	}
+	opts.config.Check = true
+	return gen(opts)
+}
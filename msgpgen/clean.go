@@ -0,0 +1,103 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strings"
+
+	"github.com/pkg/errors"
+
+	"github.com/shabbyrobe/msgpgen/msgpcmd"
+)
+
+var versionHash = regexp.MustCompile(`^[0-9a-f]{64}$`)
+
+func cmdClean(args []string) error {
+	opts := newOptions()
+	fs, err := opts.flags("clean")
+	if err != nil {
+		return err
+	}
+	dryRun := fs.Bool("n", false, "Print the files that would be removed without removing them")
+	if err := opts.parse(fs, args); err != nil {
+		return err
+	}
+	if len(opts.loader.Imports) == 0 {
+		return errors.Errorf("no packages to clean; pass -import or set it in the project file")
+	}
+
+	pkgs, err := msgpcmd.ListPackages(opts.loader.Imports)
+	if err != nil {
+		return err
+	}
+
+	config := opts.config
+	for _, pkg := range pkgs {
+		dir := msgpcmd.PackageDir(pkg)
+		if dir == "" {
+			continue
+		}
+		lpkg := filepath.Base(pkg.PkgPath)
+		expand := func(tpl string) string {
+			return filepath.Join(dir, strings.Replace(tpl, "{pkg}", lpkg, -1))
+		}
+
+		var remove []string
+		for _, file := range []string{expand(config.FileTemplate), expand(config.TestTemplate)} {
+			if ok, err := isGenerated(file); err != nil {
+				return err
+			} else if ok {
+				remove = append(remove, file)
+			}
+		}
+		if ok, err := isVersionFile(expand(config.VersionFileTemplate)); err != nil {
+			return err
+		} else if ok {
+			remove = append(remove, expand(config.VersionFileTemplate))
+		}
+		if fi, err := os.Stat(filepath.Join(dir, config.TempDirName)); err == nil && fi.IsDir() {
+			remove = append(remove, filepath.Join(dir, config.TempDirName))
+		}
+
+		for _, file := range remove {
+			fmt.Println(file)
+			if *dryRun {
+				continue
+			}
+			if err := os.RemoveAll(file); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// isGenerated reports whether file exists and has the "DO NOT EDIT" marker
+// msgp puts at the top of its output, so hand written files that happen to
+// match the template are never removed.
+func isGenerated(file string) (bool, error) {
+	b, err := ioutil.ReadFile(file)
+	if os.IsNotExist(err) {
+		return false, nil
+	} else if err != nil {
+		return false, err
+	}
+	if len(b) > 1024 {
+		b = b[:1024]
+	}
+	return bytes.Contains(b, []byte("DO NOT EDIT")), nil
+}
+
+func isVersionFile(file string) (bool, error) {
+	b, err := ioutil.ReadFile(file)
+	if os.IsNotExist(err) {
+		return false, nil
+	} else if err != nil {
+		return false, err
+	}
+	return versionHash.Match(bytes.TrimSpace(b)), nil
+}
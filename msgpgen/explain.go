@@ -0,0 +1,170 @@
+package main
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+
+	"github.com/pkg/errors"
+
+	"github.com/shabbyrobe/msgpgen"
+)
+
+func cmdExplain(args []string) error {
+	opts := newOptions()
+	fs, err := opts.flags("explain")
+	if err != nil {
+		return err
+	}
+	if err := opts.parse(fs, args); err != nil {
+		return err
+	}
+	if fs.NArg() != 1 {
+		return errors.Errorf("usage: msgpgen explain [flags] <type-or-package>")
+	}
+	target := fs.Arg(0)
+
+	sess, err := load(opts.loader, opts.config)
+	if err != nil {
+		return err
+	}
+	report := &msgpgen.Report{}
+	graph := msgpgen.NewGraph()
+	sess.config.Report = report
+	sess.config.Graph = graph
+
+	if _, err := msgpgen.Extract(sess.tpset, sess.state, sess.dctvCache, sess.config); err != nil {
+		return err
+	}
+
+	// The first real decision for each type, so we can show what happened to
+	// each type along a path. The queue only follows the first reference to
+	// a type from each package, so the report has one chain per type and
+	// package; the paths come from the graph instead, which has every
+	// reference.
+	var targets []string
+	decided := make(map[string]*msgpgen.ReportEntry)
+	origins := make(map[string][]string)
+	for i := range report.Entries {
+		entry := &report.Entries[i]
+		if _, ok := decided[entry.Type]; !ok {
+			if explainMatches(target, *entry) {
+				targets = append(targets, entry.Type)
+			}
+			decided[entry.Type] = entry
+		} else if decided[entry.Type].Decision == msgpgen.DecisionSeen && entry.Decision != msgpgen.DecisionSeen {
+			decided[entry.Type] = entry
+		}
+		origins[entry.Type] = appendUnique(origins[entry.Type], entry.Origin)
+	}
+	if len(targets) == 0 {
+		return errors.Errorf("%s was not reached from any root type", target)
+	}
+
+	roots := make(map[string]bool, len(sess.config.Types))
+	for _, t := range sess.config.Types {
+		roots[t.String()] = true
+	}
+	refs := make(map[string][]msgpgen.GraphEdge)
+	for _, edge := range graph.Edges {
+		refs[edge.To] = append(refs[edge.To], edge)
+	}
+	for _, edges := range refs {
+		sort.Slice(edges, func(i, j int) bool {
+			if edges[i].From != edges[j].From {
+				return edges[i].From < edges[j].From
+			}
+			return edges[i].Label < edges[j].Label
+		})
+	}
+
+	for _, tn := range targets {
+		entry := decided[tn]
+		fmt.Printf("%s\n", tn)
+		fmt.Printf("  decision: %s", entry.Decision)
+		if entry.File != "" {
+			fmt.Printf(" into %s", entry.File)
+		}
+		fmt.Println()
+		fmt.Printf("  referred to from packages: %s\n", strings.Join(origins[tn], ", "))
+
+		paths, more := explainPaths(tn, refs, roots)
+		for _, path := range paths {
+			names := make([]string, len(path))
+			for i, step := range path {
+				names[i] = step.To
+			}
+			fmt.Printf("  path: %s\n", strings.Join(names, " -> "))
+			for _, step := range path {
+				line := "    " + step.To
+				if step.Label != "" {
+					line += "  (" + step.From + " " + step.Label + ")"
+				}
+				if d := decided[step.To]; d != nil {
+					line += "  [" + string(d.Decision) + "]"
+					if d.Directive != "" {
+						line += "  " + d.Directive
+					}
+				}
+				fmt.Println(line)
+			}
+		}
+		if more {
+			fmt.Printf("  (only the first %d paths are shown)\n", explainMaxPaths)
+		}
+		fmt.Println()
+	}
+
+	return nil
+}
+
+const explainMaxPaths = 20
+
+// explainPaths walks the references to tn back to the root types, returning
+// each chain of edges in order from the root. The first step of each chain
+// has an empty From. Types that nothing refers to are treated as roots, so
+// every chain ends somewhere even if the type was found some other way.
+func explainPaths(tn string, refs map[string][]msgpgen.GraphEdge, roots map[string]bool) (paths [][]msgpgen.GraphEdge, more bool) {
+	onPath := make(map[string]bool)
+	var walk func(to string, tail []msgpgen.GraphEdge)
+	walk = func(to string, tail []msgpgen.GraphEdge) {
+		if len(paths) >= explainMaxPaths {
+			more = true
+			return
+		}
+		if roots[to] || len(refs[to]) == 0 {
+			path := append([]msgpgen.GraphEdge{{To: to}}, tail...)
+			paths = append(paths, path)
+			return
+		}
+		onPath[to] = true
+		for _, edge := range refs[to] {
+			if onPath[edge.From] {
+				continue
+			}
+			walk(edge.From, append([]msgpgen.GraphEdge{edge}, tail...))
+		}
+		onPath[to] = false
+	}
+	walk(tn, nil)
+	return paths, more
+}
+
+func appendUnique(list []string, s string) []string {
+	for _, v := range list {
+		if v == s {
+			return list
+		}
+	}
+	return append(list, s)
+}
+
+// explainMatches reports whether the entry is for the target type, or for a
+// type in the target package.
+func explainMatches(target string, entry msgpgen.ReportEntry) bool {
+	if entry.Type == target || entry.Package == target {
+		return true
+	}
+	idx := strings.LastIndex(entry.Type, ".")
+	return idx > 0 && entry.Type[:idx] == target
+}
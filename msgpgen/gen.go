@@ -0,0 +1,102 @@
+package main
+
+import (
+	"fmt"
+
+	"github.com/pkg/errors"
+
+	"github.com/shabbyrobe/msgpgen"
+)
+
+func cmdGen(args []string) error {
+	opts := newOptions()
+	fs, err := opts.flags("gen")
+	if err != nil {
+		return err
+	}
+	if err := opts.parse(fs, args); err != nil {
+		return err
+	}
+	return gen(opts)
+}
+
+func gen(opts *options) (rerr error) {
+	// Hold the lock from loading the state until it has been saved, so
+	// another go generate process sharing the file can't hand out the same
+	// IDs. Check mode doesn't write, so it doesn't need it.
+	if opts.loader.State != "" && !opts.config.Check {
+		unlock, err := msgpgen.LockStateFile(opts.loader.State)
+		if err != nil {
+			return err
+		}
+		defer func() {
+			if uerr := unlock(); uerr != nil && rerr == nil {
+				rerr = uerr
+			}
+		}()
+	}
+
+	sess, err := load(opts.loader, opts.config)
+	if err != nil {
+		return err
+	}
+	loader, config, state := sess.loader, sess.config, sess.state
+
+	err = msgpgen.Generate(sess.tpset, state, sess.dctvCache, config)
+	// The report and graph are still useful if generation failed part way
+	// through.
+	if config.Report != nil {
+		if rerr := config.Report.WriteFile(loader.Report); rerr != nil && err == nil {
+			err = rerr
+		}
+	}
+	if config.Graph != nil {
+		if gerr := config.Graph.WriteFile(loader.Graph); gerr != nil && err == nil {
+			err = gerr
+		}
+	}
+	if config.Check {
+		return check(sess, err)
+	}
+	if err != nil {
+		return err
+	}
+
+	if loader.State != "" {
+		if err := state.SaveToFile(loader.State); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// check adds the state file to any stale files reported by a check mode
+// Generate, printing diffs if requested.
+func check(sess *session, genErr error) error {
+	stale := &msgpgen.StaleError{}
+	if genErr != nil {
+		se, ok := errors.Cause(genErr).(*msgpgen.StaleError)
+		if !ok {
+			return genErr
+		}
+		stale = se
+	}
+
+	if sess.loader.State != "" {
+		sf, err := sess.state.CheckFile(sess.loader.State, sess.config.Diff)
+		if err != nil {
+			return err
+		}
+		if sf != nil {
+			stale.Files = append(stale.Files, *sf)
+		}
+	}
+
+	if len(stale.Files) == 0 {
+		return nil
+	}
+	for _, f := range stale.Files {
+		fmt.Print(f.Diff)
+	}
+	return stale
+}
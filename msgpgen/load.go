@@ -0,0 +1,108 @@
+package main
+
+import (
+	"github.com/pkg/errors"
+
+	"github.com/shabbyrobe/msgpgen"
+	"github.com/shabbyrobe/msgpgen/msgpcmd"
+	"github.com/shabbyrobe/structer"
+)
+
+// session is everything loaded from the flags that Generate needs.
+type session struct {
+	loader    msgpcmd.LoaderConfig
+	config    msgpgen.Config
+	tpset     *structer.TypePackageSet
+	dctvCache *msgpgen.DirectivesCache
+	state     *msgpgen.State
+}
+
+// load imports the packages and finds the root types, leaving the config
+// ready to pass to Generate.
+func load(loader msgpcmd.LoaderConfig, config msgpgen.Config) (*session, error) {
+	tpset := structer.NewTypePackageSet()
+	dctvCache := msgpgen.NewDirectivesCache(tpset)
+	if err := msgpcmd.AddGlobalDirectives(dctvCache, loader); err != nil {
+		return nil, err
+	}
+
+	pkgs, err := msgpcmd.LoadPackages(tpset, loader.Imports)
+	if err != nil {
+		return nil, err
+	}
+	config.Scope = msgpcmd.ScopeFromPackages(loader, pkgs)
+
+	var state *msgpgen.State
+	var types []structer.TypeName
+
+	if loader.State != "" && config.IDStrategy == msgpgen.IDStrategyHash {
+		return nil, errors.Errorf("-state cannot be used with -ids hash")
+	}
+	if loader.State != "" {
+		if state, err = msgpgen.LoadStateFromFile(loader.State); err != nil {
+			return nil, err
+		}
+		for _, t := range state.AllTypes() {
+			// Entries for types that have gone are skipped here; with
+			// -strict-state, Generate reports them as errors instead.
+			if o := tpset.FindObject(t); o != nil {
+				types = append(types, t)
+			} else if !config.StrictState && config.Log != nil {
+				config.Log.Log(msgpgen.LogWarn, msgpgen.LogTypeSet, msgpgen.LogGeneral,
+					"state type %s not found; pass -strict-state to make this an error", t)
+			}
+		}
+	}
+
+	if len(loader.Interfaces) > 0 {
+		var ifaceNames []structer.TypeName
+		for _, i := range loader.Interfaces {
+			tn, err := structer.ParseTypeName(i)
+			if err != nil {
+				return nil, errors.Wrapf(err, "could not parse iface type name %s", tn)
+			}
+			ifaceNames = append(ifaceNames, tn)
+		}
+
+		if itypes, err := msgpcmd.FindIfaces(tpset, ifaceNames...); err != nil {
+			return nil, err
+		} else {
+			types = append(types, itypes...)
+		}
+	}
+
+	if loader.TypesFile != "" {
+		ftypes, err := msgpcmd.LoadTypesFile(tpset, loader.TypesFile)
+		if err != nil {
+			return nil, err
+		}
+		for _, t := range ftypes {
+			// Types named explicitly in the file are always allowed to
+			// receive output, but don't switch on scoping if it isn't in use.
+			if len(config.Scope) > 0 {
+				config.Scope = append(config.Scope, t.PackagePath)
+			}
+		}
+		types = append(types, ftypes...)
+	}
+
+	if len(types) == 0 {
+		return nil, errors.Errorf("no types found in -ifaces, -state or -types-file")
+	}
+
+	config.Types = types
+	if loader.Report != "" {
+		config.Report = &msgpgen.Report{}
+	}
+	if loader.Graph != "" {
+		config.Graph = msgpgen.NewGraph()
+	}
+
+	return &session{
+		loader:    loader,
+		config:    config,
+		tpset:     tpset,
+		dctvCache: dctvCache,
+		state:     state,
+	}, nil
+}
@@ -2,108 +2,100 @@ package main
 
 import (
 	"flag"
+	"fmt"
 	"log"
 	"os"
+	"sort"
+	"strings"
 
 	"github.com/pkg/errors"
 
 	"github.com/shabbyrobe/msgpgen"
 	"github.com/shabbyrobe/msgpgen/msgpcmd"
-	"github.com/shabbyrobe/structer"
 )
 
+type command struct {
+	run   func(args []string) error
+	usage string
+}
+
+var commands = map[string]command{
+	"gen":     {cmdGen, "Generate code (the default if no command is given)"},
+	"check":   {cmdCheck, "Fail if any generated file or the state file is out of date"},
+	"explain": {cmdExplain, "Show the paths from the root types that reached a type or package"},
+	"state":   {cmdState, "Inspect, validate or edit the state file"},
+	"clean":   {cmdClean, "Remove generated files and stray temp dirs"},
+}
+
 func main() {
-	if err := run(); err != nil {
+	if err := run(os.Args[1:]); err != nil {
 		log.Fatal(err)
 	}
 }
 
-func run() error {
-	config := msgpgen.NewConfig()
-	loader := msgpcmd.LoaderConfig{}
-
-	flags := flag.NewFlagSet("msgpgen", flag.ContinueOnError)
-	if err := msgpcmd.ConfigFlags(flags, &config); err != nil {
-		return err
+func run(args []string) error {
+	// Bare invocations with flags are treated as 'gen' so existing
+	// //go:generate lines keep working.
+	if len(args) == 0 || strings.HasPrefix(args[0], "-") {
+		return cmdGen(args)
 	}
-	if err := msgpcmd.LoaderFlags(flags, &loader); err != nil {
-		return err
-	}
-	if err := flags.Parse(os.Args[1:]); err != nil {
-		return err
+
+	if args[0] == "help" {
+		usage()
+		return nil
 	}
-	if err := gen(loader, config, flags.Args()); err != nil {
-		return err
+
+	cmd, ok := commands[args[0]]
+	if !ok {
+		usage()
+		return errors.Errorf("unknown command %q", args[0])
 	}
-	return nil
+	return cmd.run(args[1:])
 }
 
-func gen(loader msgpcmd.LoaderConfig, config msgpgen.Config, args []string) error {
-	tpset := structer.NewTypePackageSet()
-	dctvCache := msgpgen.NewDirectivesCache(tpset)
-
-	var imports []string
-	var err error
-	if len(loader.Imports) > 0 {
-		imports, err = msgpcmd.GoList(loader.Imports)
-		if err != nil {
-			return errors.Wrapf(err, "go list failed")
-		}
+func usage() {
+	var names []string
+	for name := range commands {
+		names = append(names, name)
 	}
+	sort.Strings(names)
 
-	for _, imp := range imports {
-		// should be safe to ignore import errors - it will raise issues
-		// if there are any type resolution errors at all, which we don't
-		// necessarily care about - we may have incomplete types that won't
-		// be complete until the generator runs!
-		_, _ = tpset.Import(imp)
+	fmt.Fprintf(os.Stderr, "Usage: msgpgen [command] [flags]\n\nCommands:\n")
+	for _, name := range names {
+		fmt.Fprintf(os.Stderr, "  %-8s %s\n", name, commands[name].usage)
 	}
+	fmt.Fprintf(os.Stderr, "\nRun 'msgpgen <command> -help' for the flags of each command.\n")
+}
 
-	var state *msgpgen.State
-	var types []structer.TypeName
-
-	if loader.State != "" {
-		if state, err = msgpgen.LoadStateFromFile(loader.State); err != nil {
-			return err
-		}
-		for t := range state.Types {
-			// FIXME: strict mode to require types
-			if o := tpset.FindObject(t); o != nil {
-				types = append(types, t)
-			}
-		}
-	}
+// options holds the flags shared by most commands.
+type options struct {
+	config msgpgen.Config
+	loader msgpcmd.LoaderConfig
+	log    msgpcmd.LogConfig
+}
 
-	if len(loader.Interfaces) > 0 {
-		var ifaceNames []structer.TypeName
-		for _, i := range loader.Interfaces {
-			tn, err := structer.ParseTypeName(i)
-			if err != nil {
-				return errors.Wrapf(err, "could not parse iface type name %s", tn)
-			}
-			ifaceNames = append(ifaceNames, tn)
-		}
+func newOptions() *options {
+	return &options{config: msgpgen.NewConfig()}
+}
 
-		if itypes, err := msgpcmd.FindIfaces(tpset, ifaceNames...); err != nil {
-			return err
-		} else {
-			types = append(types, itypes...)
-		}
+func (o *options) flags(name string) (*flag.FlagSet, error) {
+	fs := flag.NewFlagSet("msgpgen "+name, flag.ContinueOnError)
+	if err := msgpcmd.ConfigFlags(fs, &o.config); err != nil {
+		return nil, err
 	}
-
-	if len(types) == 0 {
-		return errors.Errorf("no types found in -ifaces or -state")
+	if err := msgpcmd.LoaderFlags(fs, &o.loader); err != nil {
+		return nil, err
 	}
-
-	config.Types = types
-	if err := msgpgen.Generate(tpset, state, dctvCache, config); err != nil {
-		return err
+	if err := msgpcmd.LogFlags(fs, &o.log); err != nil {
+		return nil, err
 	}
+	return fs, nil
+}
 
-	if loader.State != "" {
-		if err := state.SaveToFile(loader.State); err != nil {
-			return err
-		}
+func (o *options) parse(fs *flag.FlagSet, args []string) error {
+	if err := fs.Parse(args); err != nil {
+		return err
 	}
-	return nil
+	o.config.Log = o.log.Log(os.Stderr)
+	return msgpcmd.ApplyProject(fs, &o.config, &o.loader)
 }
@@ -0,0 +1,358 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"text/tabwriter"
+
+	"github.com/pkg/errors"
+
+	"github.com/shabbyrobe/msgpgen"
+	"github.com/shabbyrobe/structer"
+)
+
+type stateAction struct {
+	run   func(opts *options, args []string) error
+	args  string
+	usage string
+
+	// Set if the action takes its files as arguments rather than using
+	// -state.
+	standalone bool
+}
+
+var stateActions = map[string]stateAction{
+	"show":        {stateShow, "", "List the IDs in the state file", false},
+	"validate":    {stateValidate, "", "Check the state file against the code; pass -import and -ifaces", false},
+	"set":         {stateSet, "<type> <id>", "Assign an ID to a type that has none; pass -ifaces if the state is namespaced", false},
+	"namespace":   {stateNamespace, "", "Give each interface its own ID space, keeping existing IDs", false},
+	"mv":          {stateMv, "<old> <new>", "Rename or move a type, keeping its ID", false},
+	"merge":       {stateMerge, "<base> <ours> <theirs>", "Three way merge of state files, writing the result to <ours>; for use as a git merge driver", true},
+	"retire":      {stateRetire, "<type>", "Remove a type, keeping its ID as a tombstone so it is never reused", false},
+	"rm":          {stateRetire, "<type>", "Same as retire", false},
+	"deprecate":   {stateDeprecate(true), "<type>", "Mark a type as deprecated", false},
+	"undeprecate": {stateDeprecate(false), "<type>", "Remove the deprecated mark from a type", false},
+}
+
+func cmdState(args []string) (rerr error) {
+	if len(args) == 0 || args[0] == "help" {
+		stateUsage()
+		return nil
+	}
+	action, ok := stateActions[args[0]]
+	if !ok {
+		stateUsage()
+		return errors.Errorf("unknown state action %q", args[0])
+	}
+
+	opts := newOptions()
+	fs, err := opts.flags("state " + args[0])
+	if err != nil {
+		return err
+	}
+	if err := opts.parse(fs, args[1:]); err != nil {
+		return err
+	}
+	if action.standalone {
+		return action.run(opts, fs.Args())
+	}
+	if opts.loader.State == "" {
+		return errors.Errorf("no state file; pass -state or set it in the project file")
+	}
+
+	unlock, err := msgpgen.LockStateFile(opts.loader.State)
+	if err != nil {
+		return err
+	}
+	defer func() {
+		if uerr := unlock(); uerr != nil && rerr == nil {
+			rerr = uerr
+		}
+	}()
+	return action.run(opts, fs.Args())
+}
+
+func stateUsage() {
+	var names []string
+	for name := range stateActions {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	fmt.Fprintf(os.Stderr, "Usage: msgpgen state <action> -state <file> [flags] [args]\n\nActions:\n")
+	for _, name := range names {
+		a := stateActions[name]
+		fmt.Fprintf(os.Stderr, "  %-20s %s\n", name+" "+a.args, a.usage)
+	}
+}
+
+func loadStateFile(opts *options) (*msgpgen.State, error) {
+	state, err := msgpgen.LoadStateFromFile(opts.loader.State)
+	if err != nil {
+		return nil, errors.Wrapf(err, "could not load state file %s", opts.loader.State)
+	}
+	return state, nil
+}
+
+func stateShow(opts *options, args []string) error {
+	state, err := loadStateFile(opts)
+	if err != nil {
+		return err
+	}
+
+	tw := tabwriter.NewWriter(os.Stdout, 0, 4, 2, ' ', 0)
+	if len(state.Types) > 0 || len(state.Retired) > 0 || !state.Namespaced {
+		showSpace(tw, &state.StateSpace)
+	}
+	for _, iface := range state.SortedIfaces() {
+		fmt.Fprintf(tw, "\n[%s]\n", iface)
+		showSpace(tw, state.Ifaces[iface])
+	}
+	return tw.Flush()
+}
+
+func showSpace(tw *tabwriter.Writer, space *msgpgen.StateSpace) {
+	names := space.SortedNames()
+	sort.SliceStable(names, func(i, j int) bool {
+		return space.Types[names[i]].ID < space.Types[names[j]].ID
+	})
+
+	fmt.Fprintf(tw, "ID\tTYPE\tIFACES\tADDED\tFLAGS\n")
+	for _, r := range space.Retired {
+		fmt.Fprintf(tw, "%d\t%s\t\t\tretired:%s\n", r.ID, r.Type, r.Retired)
+	}
+	for _, tn := range names {
+		st := space.Types[tn]
+		var flags []string
+		if st.Deprecated {
+			flags = append(flags, "deprecated")
+		}
+		for _, f := range st.Formerly {
+			flags = append(flags, "formerly:"+f)
+		}
+		fmt.Fprintf(tw, "%d\t%s\t%s\t%s\t%s\n", st.ID, tn,
+			strings.Join(st.Ifaces, ","), st.Added, strings.Join(flags, " "))
+	}
+}
+
+// stateValidate checks the state file against the code: entries whose type
+// has gone or no longer implements an intercepted interface, duplicate IDs,
+// and implementers that have not been given an ID. Without -import, -ifaces
+// or -types-file, only the file itself is checked.
+func stateValidate(opts *options, args []string) error {
+	raw, err := msgpgen.ReadStateFile(opts.loader.State)
+	if err != nil {
+		return errors.Wrapf(err, "could not load state file %s", opts.loader.State)
+	}
+	if problems := raw.DuplicateIDs(); len(problems) > 0 {
+		return reportStateProblems(problems)
+	}
+
+	if len(opts.loader.Imports) == 0 {
+		if _, err := loadStateFile(opts); err != nil {
+			return err
+		}
+		fmt.Println("ok (pass -import to check the state against the code)")
+		return nil
+	}
+
+	sess, err := load(opts.loader, opts.config)
+	if err != nil {
+		return err
+	}
+
+	// Extract assigns IDs to new implementers, so run it on a copy to see
+	// which ones are missing from the file.
+	work, err := sess.state.Clone()
+	if err != nil {
+		return err
+	}
+	extn, err := msgpgen.Extract(sess.tpset, work, sess.dctvCache, sess.config)
+	if err != nil {
+		return err
+	}
+	if problems := msgpgen.ValidateState(sess.tpset, sess.state, extn); len(problems) > 0 {
+		return reportStateProblems(problems)
+	}
+	fmt.Println("ok")
+	return nil
+}
+
+func reportStateProblems(problems []msgpgen.StateProblem) error {
+	for _, p := range problems {
+		fmt.Printf("%s: %s\n", p.Kind, p)
+	}
+	return errors.Errorf("state file has %d problem(s)", len(problems))
+}
+
+func stateSet(opts *options, args []string) error {
+	if len(args) != 2 {
+		return errors.Errorf("expected <type> <id>")
+	}
+	tn, err := structer.ParseTypeName(args[0])
+	if err != nil {
+		return err
+	}
+	id, err := strconv.Atoi(args[1])
+	if err != nil {
+		return errors.Wrapf(err, "invalid ID %q", args[1])
+	}
+
+	state, err := loadStateFile(opts)
+	if err != nil {
+		return err
+	}
+
+	space := &state.StateSpace
+	if state.Namespaced {
+		if len(opts.loader.Interfaces) != 1 {
+			return errors.Errorf("state is namespaced; pass the interface the type belongs to with -ifaces")
+		}
+		iface, err := structer.ParseTypeName(opts.loader.Interfaces[0])
+		if err != nil {
+			return err
+		}
+		space = state.Space(iface)
+	}
+	if err := space.Set(tn, id); err != nil {
+		return err
+	}
+	return state.SaveToFile(opts.loader.State)
+}
+
+func stateNamespace(opts *options, args []string) error {
+	state, err := loadStateFile(opts)
+	if err != nil {
+		return err
+	}
+	if err := state.Namespace(); err != nil {
+		return err
+	}
+	return state.SaveToFile(opts.loader.State)
+}
+
+func stateMv(opts *options, args []string) error {
+	if len(args) != 2 {
+		return errors.Errorf("expected <old> <new>")
+	}
+	from, err := structer.ParseTypeName(args[0])
+	if err != nil {
+		return err
+	}
+	to, err := structer.ParseTypeName(args[1])
+	if err != nil {
+		return err
+	}
+
+	state, err := loadStateFile(opts)
+	if err != nil {
+		return err
+	}
+	if err := state.Rename(from, to); err != nil {
+		return err
+	}
+	return state.SaveToFile(opts.loader.State)
+}
+
+// stateMerge is a git merge driver for state files. Configure it with:
+//
+//	git config merge.msgpgen.driver 'msgpgen state merge -state state.json %O %A %B'
+//	echo 'state.json merge=msgpgen' >> .gitattributes
+//
+// The merge holds the same lock as the other state actions: the one for
+// -state if it is set, otherwise the one for <ours>.
+func stateMerge(opts *options, args []string) (rerr error) {
+	if len(args) != 3 {
+		return errors.Errorf("expected <base> <ours> <theirs>")
+	}
+
+	lock := opts.loader.State
+	if lock == "" {
+		lock = args[1]
+	}
+	unlock, err := msgpgen.LockStateFile(lock)
+	if err != nil {
+		return err
+	}
+	defer func() {
+		if uerr := unlock(); uerr != nil && rerr == nil {
+			rerr = uerr
+		}
+	}()
+
+	var states [3]*msgpgen.State
+	for i, file := range args {
+		state, err := readMergeState(file)
+		if err != nil {
+			return err
+		}
+		states[i] = state
+	}
+
+	merged, renumbered, err := msgpgen.MergeStates(states[0], states[1], states[2])
+	if err != nil {
+		return err
+	}
+	for _, r := range renumbered {
+		fmt.Fprintf(os.Stderr, "msgpgen: %s; regenerate before using the merged state\n", r)
+	}
+
+	return merged.SaveToFile(args[1])
+}
+
+// readMergeState loads one side of a merge. Git passes an empty file as the
+// base if the state file was added on both branches.
+func readMergeState(file string) (*msgpgen.State, error) {
+	if info, err := os.Stat(file); err == nil && info.Size() == 0 {
+		state := &msgpgen.State{}
+		return state, state.Init()
+	}
+	state, err := msgpgen.LoadStateFromFile(file)
+	if err != nil {
+		return nil, errors.Wrapf(err, "could not load state file %s", file)
+	}
+	return state, nil
+}
+
+func stateRetire(opts *options, args []string) error {
+	if len(args) != 1 {
+		return errors.Errorf("expected <type>")
+	}
+	tn, err := structer.ParseTypeName(args[0])
+	if err != nil {
+		return err
+	}
+
+	state, err := loadStateFile(opts)
+	if err != nil {
+		return err
+	}
+	if err := state.Retire(tn); err != nil {
+		return err
+	}
+	return state.SaveToFile(opts.loader.State)
+}
+
+func stateDeprecate(deprecated bool) func(opts *options, args []string) error {
+	return func(opts *options, args []string) error {
+		if len(args) != 1 {
+			return errors.Errorf("expected <type>")
+		}
+		tn, err := structer.ParseTypeName(args[0])
+		if err != nil {
+			return err
+		}
+
+		state, err := loadStateFile(opts)
+		if err != nil {
+			return err
+		}
+		if err := state.Deprecate(tn, deprecated); err != nil {
+			return err
+		}
+		return state.SaveToFile(opts.loader.State)
+	}
+}
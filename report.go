@@ -0,0 +1,98 @@
+package msgpgen
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"path/filepath"
+	"strings"
+
+	"github.com/shabbyrobe/structer"
+)
+
+// Decision describes what the extractor did with a type it took from the
+// type queue.
+type Decision string
+
+const (
+	// The type is supported by msgp without any generated code.
+	DecisionSupported Decision = "supported"
+
+	// The type was already handled when it was reached from another package.
+	DecisionSeen Decision = "seen"
+
+	// A //msgp:shim directive in the referring package covers the type.
+	DecisionShimmed Decision = "shimmed"
+
+	// A //msgp:ignore directive in the declaring package covers the type.
+	DecisionIgnored Decision = "ignored"
+
+	// The type is a named primitive and has been shimmed with a cast into the
+	// referring package.
+	DecisionAutoShim Decision = "autoshim"
+
+	// The type's definition was extracted and code will be generated for it.
+	DecisionExtracted Decision = "extracted"
+
+	// The type is an interface; its implementers were queued and an
+	// interceptor will be generated for it.
+	DecisionInterface Decision = "interface"
+)
+
+// ReportEntry records the decision made for a single TypeQueueItem.
+type ReportEntry struct {
+	Type      string   `json:"type"`
+	Origin    string   `json:"origin"`
+	Parents   []string `json:"parents,omitempty"`
+	Decision  Decision `json:"decision"`
+	Directive string   `json:"directive,omitempty"`
+
+	// Package and file the generated output for this type was written to, if
+	// any.
+	Package string `json:"package,omitempty"`
+	File    string `json:"file,omitempty"`
+}
+
+// Report collects a ReportEntry for every type the extractor handles, in the
+// order they were handled. Assign an empty Report to Config.Report to have
+// Generate populate it.
+type Report struct {
+	Entries []ReportEntry `json:"entries"`
+}
+
+func (r *Report) add(tqi *TypeQueueItem, decision Decision, directive string, pkg string) {
+	entry := ReportEntry{
+		Type:      tqi.Name,
+		Origin:    tqi.OriginPkg,
+		Decision:  decision,
+		Directive: directive,
+		Package:   pkg,
+	}
+	for _, p := range tqi.Parents {
+		entry.Parents = append(entry.Parents, p.String())
+	}
+	r.Entries = append(r.Entries, entry)
+}
+
+// resolveFiles fills in the File for each entry that has a Package.
+func (r *Report) resolveFiles(tpset *structer.TypePackageSet, config Config) {
+	for i := range r.Entries {
+		entry := &r.Entries[i]
+		if entry.Package == "" {
+			continue
+		}
+		astPkg := tpset.ASTPackages.Packages[entry.Package]
+		if astPkg == nil {
+			continue
+		}
+		lpkg := filepath.Base(entry.Package)
+		entry.File = filepath.Join(astPkg.FullPath, strings.Replace(config.FileTemplate, "{pkg}", lpkg, -1))
+	}
+}
+
+func (r *Report) WriteFile(file string) error {
+	b, err := json.MarshalIndent(r, "", "  ")
+	if err != nil {
+		return err
+	}
+	return ioutil.WriteFile(file, b, 0644)
+}
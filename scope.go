@@ -0,0 +1,43 @@
+package msgpgen
+
+import (
+	"regexp"
+	"strings"
+)
+
+// packageScope holds the compiled import path patterns of the packages that
+// generated output may be written into. An empty scope allows every package.
+type packageScope []*regexp.Regexp
+
+func newPackageScope(patterns []string) packageScope {
+	scope := make(packageScope, len(patterns))
+	for i, pattern := range patterns {
+		scope[i] = packagePattern(pattern)
+	}
+	return scope
+}
+
+// allows reports whether generated output may be written into pkg.
+func (s packageScope) allows(pkg string) bool {
+	if len(s) == 0 {
+		return true
+	}
+	for _, re := range s {
+		if re.MatchString(pkg) {
+			return true
+		}
+	}
+	return false
+}
+
+// packagePattern compiles an import path pattern. Patterns follow the same
+// rules as 'go list': "..." matches any string, including the empty string
+// and strings containing slashes, and "foo/..." also matches "foo" itself.
+func packagePattern(pattern string) *regexp.Regexp {
+	re := regexp.QuoteMeta(pattern)
+	re = strings.Replace(re, `\.\.\.`, `.*`, -1)
+	if strings.HasSuffix(re, `/.*`) {
+		re = re[:len(re)-len(`/.*`)] + `(/.*)?`
+	}
+	return regexp.MustCompile(`^` + re + `$`)
+}
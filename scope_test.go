@@ -0,0 +1,29 @@
+package msgpgen
+
+import "testing"
+
+func TestPackageScope(t *testing.T) {
+	for _, tc := range []struct {
+		patterns []string
+		pkg      string
+		allowed  bool
+	}{
+		{nil, "github.com/foo/bar", true},
+		{[]string{"github.com/foo/bar"}, "github.com/foo/bar", true},
+		{[]string{"github.com/foo/bar"}, "github.com/foo/bar/baz", false},
+		{[]string{"github.com/foo/bar"}, "github.com/foo/barbaz", false},
+		{[]string{"github.com/foo/..."}, "github.com/foo", true},
+		{[]string{"github.com/foo/..."}, "github.com/foo/bar/baz", true},
+		{[]string{"github.com/foo/..."}, "github.com/foobar", false},
+		{[]string{"github.com/foo..."}, "github.com/foobar/baz", true},
+		{[]string{"github.com/.../internal"}, "github.com/foo/bar/internal", true},
+		{[]string{"github.com/.../internal"}, "github.com/foo/internal/x", false},
+		{[]string{"github.com/f.o"}, "github.com/fxo", false},
+		{[]string{"github.com/a", "github.com/b/..."}, "github.com/b/c", true},
+		{[]string{"github.com/a", "github.com/b/..."}, "github.com/c", false},
+	} {
+		if allowed := newPackageScope(tc.patterns).allows(tc.pkg); allowed != tc.allowed {
+			t.Errorf("%q allows %s: %v != %v", tc.patterns, tc.pkg, allowed, tc.allowed)
+		}
+	}
+}
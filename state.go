@@ -2,91 +2,540 @@ package msgpgen
 
 import (
 	"bytes"
+	"crypto/sha256"
 	"encoding/json"
 	"fmt"
-	"io"
+	"io/ioutil"
 	"os"
+	"path/filepath"
 	"sort"
+	"strings"
+	"time"
 
+	"github.com/pkg/errors"
 	"github.com/shabbyrobe/structer"
 )
 
-type StateTypes map[structer.TypeName]int
+// StateVersion is the version of the state file layout written by SaveToFile.
+// Files without a version use the original layout, which mapped each type
+// name directly to its ID; they are upgraded when loaded. Version 3 added
+// per-interface namespaces.
+const StateVersion = 3
+
+// stateNow returns the time recorded when a type is added to the state.
+var stateNow = time.Now
+
+// StateType holds the ID of a type in the state file, along with metadata
+// about it.
+type StateType struct {
+	ID int
+
+	// Interfaces the type was found implementing, sorted.
+	Ifaces []string `json:",omitempty"`
+
+	// Date the type was added, in YYYY-MM-DD form. Types upgraded from the
+	// legacy layout have no date.
+	Added string `json:",omitempty"`
+
+	Deprecated bool `json:",omitempty"`
+
+	// Names the type has been known by in the past.
+	Formerly []string `json:",omitempty"`
+}
+
+func (st *StateType) addIface(iface structer.TypeName) {
+	name := iface.String()
+	for _, i := range st.Ifaces {
+		if i == name {
+			return
+		}
+	}
+	st.Ifaces = append(st.Ifaces, name)
+	sort.Strings(st.Ifaces)
+}
+
+type StateTypes map[structer.TypeName]*StateType
 
 func (s *StateTypes) UnmarshalJSON(b []byte) error {
-	var m map[string]int
+	var m map[string]json.RawMessage
 	if err := json.Unmarshal(b, &m); err != nil {
 		return err
 	}
 	*s = make(StateTypes, len(m))
-	for ts, id := range m {
+	for ts, raw := range m {
 		tn, err := structer.ParseTypeName(ts)
 		if err != nil {
 			return err
 		}
-		(*s)[tn] = id
+
+		st := &StateType{}
+		if raw = bytes.TrimSpace(raw); len(raw) > 0 && raw[0] == '{' {
+			if err := json.Unmarshal(raw, st); err != nil {
+				return errors.Wrapf(err, "invalid state entry for %s", ts)
+			}
+		} else {
+			// legacy layout: the value is the bare ID
+			if err := json.Unmarshal(raw, &st.ID); err != nil {
+				return errors.Wrapf(err, "invalid state entry for %s", ts)
+			}
+		}
+		(*s)[tn] = st
 	}
 	return nil
 }
 
 func (s StateTypes) MarshalJSON() (b []byte, err error) {
-	var m = make(map[string]int, len(s))
-	for tn, id := range s {
-		m[tn.String()] = id
+	var m = make(map[string]*StateType, len(s))
+	for tn, st := range s {
+		m[tn.String()] = st
+	}
+	return json.Marshal(m)
+}
+
+type StateSpaces map[structer.TypeName]*StateSpace
+
+func (s *StateSpaces) UnmarshalJSON(b []byte) error {
+	var m map[string]*StateSpace
+	if err := json.Unmarshal(b, &m); err != nil {
+		return err
+	}
+	*s = make(StateSpaces, len(m))
+	for ts, space := range m {
+		tn, err := structer.ParseTypeName(ts)
+		if err != nil {
+			return err
+		}
+		(*s)[tn] = space
+	}
+	return nil
+}
+
+func (s StateSpaces) MarshalJSON() (b []byte, err error) {
+	var m = make(map[string]*StateSpace, len(s))
+	for tn, space := range s {
+		m[tn.String()] = space
 	}
 	return json.Marshal(m)
 }
 
 func LoadStateFromFile(file string) (*State, error) {
+	state, err := ReadStateFile(file)
+	if err != nil {
+		return nil, err
+	}
+	if err := state.Init(); err != nil {
+		return nil, err
+	}
+	return state, nil
+}
+
+// ReadStateFile reads the state file without calling Init, so a state with
+// duplicate IDs can still be inspected. Use LoadStateFromFile for a state
+// that is ready to use.
+func ReadStateFile(file string) (*State, error) {
 	state := &State{}
-	f, err := os.Open(file)
-	defer f.Close()
+	b, err := ioutil.ReadFile(file)
 
 	if !os.IsNotExist(err) {
 		if err != nil {
 			return nil, err
 		}
-		if err := json.NewDecoder(f).Decode(state); err != nil {
+		if err := json.Unmarshal(b, state); err != nil {
 			return nil, err
 		}
+		state.loaded = sha256.Sum256(b)
+		if state.Version > StateVersion {
+			return nil, errors.Errorf("state file %s has version %d, but this version of msgpgen only supports up to %d",
+				file, state.Version, StateVersion)
+		}
 	} else {
 		state.New = true
 	}
-	if err := state.Init(); err != nil {
-		return nil, err
-	}
 	return state, nil
 }
 
 type State struct {
-	Types  StateTypes
-	NextID int  `json:"-"`
-	New    bool `json:"-"`
+	// Version of the layout the state was loaded from. Init upgrades it to
+	// StateVersion, so the state is always saved in the current layout.
+	Version int
+
+	// The global ID space, shared by the implementers of every interface.
+	// Its fields appear at the top level of the file.
+	StateSpace
+
+	// If set, the implementers of each interface are given IDs from a
+	// separate space in Ifaces rather than the global space. Use Namespace
+	// to migrate a state file to this layout.
+	Namespaced bool        `json:",omitempty"`
+	Ifaces     StateSpaces `json:",omitempty"`
+
+	New bool `json:"-"`
+
+	// Hash of the file the state was read from, used by SaveToFile to
+	// detect changes made by another process since it was loaded.
+	loaded [sha256.Size]byte
+}
+
+// StateSpace is a set of types with unique IDs.
+type StateSpace struct {
+	Types StateTypes
+
+	// IDs that belonged to types that have since been removed. Persisted
+	// data may still contain them, so they are never assigned again.
+	Retired []RetiredID `json:",omitempty"`
+
+	// The next ID to assign. This is saved so that even if the entry with
+	// the highest ID is deleted from the file by hand, its ID is not reused.
+	NextID int
+}
+
+// RetiredID is a tombstone for an ID that must never be reused.
+type RetiredID struct {
+	ID   int
+	Type string
+
+	// Date the ID was retired, in YYYY-MM-DD form.
+	Retired string `json:",omitempty"`
 }
 
+// Marshal returns the state in the indented JSON form written by SaveToFile.
+func (s *State) Marshal() ([]byte, error) {
+	b, err := json.Marshal(s)
+	if err != nil {
+		return nil, err
+	}
+	var out bytes.Buffer
+	if err := json.Indent(&out, b, "", "  "); err != nil {
+		return nil, err
+	}
+	return out.Bytes(), nil
+}
+
+// Clone returns a deep copy of the state.
+func (s *State) Clone() (*State, error) {
+	b, err := json.Marshal(s)
+	if err != nil {
+		return nil, err
+	}
+	clone := &State{New: s.New, loaded: s.loaded}
+	if err := json.Unmarshal(b, clone); err != nil {
+		return nil, err
+	}
+	if err := clone.Init(); err != nil {
+		return nil, err
+	}
+	return clone, nil
+}
+
+// CheckFile compares the state with the contents of file, returning a
+// *StaleFile if they differ or nil if they match. If diff is true, the
+// returned StaleFile contains a unified diff.
+func (s *State) CheckFile(file string, diff bool) (*StaleFile, error) {
+	b, err := s.Marshal()
+	if err != nil {
+		return nil, err
+	}
+	cur, err := ioutil.ReadFile(file)
+	if err != nil && !os.IsNotExist(err) {
+		return nil, err
+	}
+	if err == nil && bytes.Equal(cur, b) {
+		return nil, nil
+	}
+
+	sf := &StaleFile{Path: file}
+	if diff {
+		if sf.Diff, err = unifiedDiff(file, cur, b); err != nil {
+			return nil, err
+		}
+	}
+	return sf, nil
+}
+
+// SaveToFile writes the state to a temporary file alongside file, then
+// renames it into place, so a crash part way through can never leave a
+// truncated state file behind. It fails if file has been changed or created
+// by someone else since the state was loaded. Use LockStateFile to stop
+// other msgpgen processes from doing that.
 func (s *State) SaveToFile(file string) (err error) {
 	var b []byte
-	if b, err = json.Marshal(s); err != nil {
+	if b, err = s.Marshal(); err != nil {
 		return
 	}
-	var out bytes.Buffer
-	json.Indent(&out, b, "", "  ")
 
-	var f *os.File
-	f, err = os.OpenFile(file, os.O_CREATE|os.O_TRUNC|os.O_WRONLY, 0600)
+	cur, err := ioutil.ReadFile(file)
+	if os.IsNotExist(err) {
+		if !s.New {
+			return errors.Errorf("state file %s was removed since it was loaded", file)
+		}
+	} else if err != nil {
+		return err
+	} else if s.New || sha256.Sum256(cur) != s.loaded {
+		return errors.Errorf("state file %s changed on disk since it was loaded; run again to pick up the changes", file)
+	}
+
+	mode := os.FileMode(0600)
+	if info, serr := os.Stat(file); serr == nil {
+		mode = info.Mode().Perm()
+	}
+
+	f, err := ioutil.TempFile(filepath.Dir(file), "."+filepath.Base(file)+".")
 	if err != nil {
-		return
+		return err
 	}
+	tmp := f.Name()
 	defer func() {
-		if cerr := f.Close(); err != nil {
-			err = cerr
+		if err != nil {
+			os.Remove(tmp)
 		}
 	}()
-	_, err = io.Copy(f, &out)
-	return
+
+	if _, err = f.Write(b); err != nil {
+		f.Close()
+		return
+	}
+	if err = f.Sync(); err != nil {
+		f.Close()
+		return
+	}
+	if err = f.Close(); err != nil {
+		return
+	}
+	if err = os.Chmod(tmp, mode); err != nil {
+		return
+	}
+	if err = os.Rename(tmp, file); err != nil {
+		return
+	}
+
+	s.New = false
+	s.loaded = sha256.Sum256(b)
+	return nil
+}
+
+// LockStateFile takes an exclusive advisory lock on file+".lock", blocking
+// until any other msgpgen process holding it releases it. Hold the lock from
+// loading the state until it has been saved. The lock file is left in place
+// after unlocking; removing it would let two processes lock different files.
+// On platforms without flock or LockFileEx, such as solaris or wasm, no lock
+// is taken.
+func LockStateFile(file string) (unlock func() error, err error) {
+	f, err := os.OpenFile(file+".lock", os.O_CREATE|os.O_RDWR, 0600)
+	if err != nil {
+		return nil, err
+	}
+	if err := lockFile(f); err != nil {
+		f.Close()
+		return nil, errors.Wrapf(err, "could not lock state file %s", file)
+	}
+	return func() error {
+		uerr := unlockFile(f)
+		if cerr := f.Close(); cerr != nil && uerr == nil {
+			uerr = cerr
+		}
+		return uerr
+	}, nil
 }
 
 func (s *State) Init() error {
+	s.Version = StateVersion
+	if err := s.StateSpace.init(); err != nil {
+		return err
+	}
+	if s.Ifaces == nil {
+		s.Ifaces = make(StateSpaces)
+	}
+	for iface, space := range s.Ifaces {
+		if err := space.init(); err != nil {
+			return errors.Wrapf(err, "interface %s", iface)
+		}
+	}
+	return nil
+}
+
+// Space returns the ID space used for the implementers of iface. This is the
+// global space unless the state is namespaced.
+func (s *State) Space(iface structer.TypeName) *StateSpace {
+	if !s.Namespaced {
+		return &s.StateSpace
+	}
+	space, ok := s.Ifaces[iface]
+	if !ok {
+		space = &StateSpace{}
+		space.init()
+		s.Ifaces[iface] = space
+	}
+	return space
+}
+
+// spaces returns every ID space in the state, with the global space first.
+func (s *State) spaces() []*StateSpace {
+	spaces := []*StateSpace{&s.StateSpace}
+	for _, iface := range s.SortedIfaces() {
+		spaces = append(spaces, s.Ifaces[iface])
+	}
+	return spaces
+}
+
+// SortedIfaces returns the interfaces that have their own ID space.
+func (s *State) SortedIfaces() []structer.TypeName {
+	names := make([]structer.TypeName, 0, len(s.Ifaces))
+	for name := range s.Ifaces {
+		names = append(names, name)
+	}
+	sort.Slice(names, func(i, j int) bool {
+		return names[i].String() < names[j].String()
+	})
+	return names
+}
+
+// AllTypes returns every type in every ID space, sorted.
+func (s *State) AllTypes() []structer.TypeName {
+	seen := make(map[structer.TypeName]bool)
+	var names []structer.TypeName
+	for _, space := range s.spaces() {
+		for name := range space.Types {
+			if !seen[name] {
+				seen[name] = true
+				names = append(names, name)
+			}
+		}
+	}
+	sort.Slice(names, func(i, j int) bool {
+		return names[i].String() < names[j].String()
+	})
+	return names
+}
+
+// TypeID returns the ID assigned to the type as an implementer of iface.
+func (s *State) TypeID(iface, t structer.TypeName) (int, bool) {
+	return s.Space(iface).TypeID(t)
+}
+
+// EnsureType returns the ID of a type that implements iface, assigning the
+// next free ID if it does not have one yet.
+func (s *State) EnsureType(t structer.TypeName, iface structer.TypeName) (int, error) {
+	return s.Space(iface).ensure(t, iface)
+}
+
+// assignID ensures the type has an ID as an implementer of iface. If pin is
+// not zero, the type must either already have that ID or be new, in which
+// case it is given the pinned ID.
+func (s *State) assignID(t, iface structer.TypeName, pin int) (int, error) {
+	space := s.Space(iface)
+	if pin != 0 {
+		if id, ok := space.TypeID(t); !ok {
+			if err := space.Set(t, pin); err != nil {
+				return 0, errors.Wrapf(err, "could not apply //msgp:typeid for %s", t)
+			}
+		} else if id != pin {
+			return 0, errors.Errorf("%s is pinned to ID %d by //msgp:typeid, but has ID %d in the state file", t, pin, id)
+		}
+	}
+	return space.ensure(t, iface)
+}
+
+// Retire retires the type in every ID space it appears in.
+func (s *State) Retire(t structer.TypeName) error {
+	found := false
+	for _, space := range s.spaces() {
+		if _, ok := space.Types[t]; ok {
+			found = true
+			if err := space.Retire(t); err != nil {
+				return err
+			}
+		}
+	}
+	if !found {
+		return fmt.Errorf("type %s not found in state", t)
+	}
+	return nil
+}
+
+// Rename moves a type's entry to a new name in every ID space it appears in,
+// keeping its ID and recording the old name in Formerly.
+func (s *State) Rename(from, to structer.TypeName) error {
+	found := false
+	for _, space := range s.spaces() {
+		if _, ok := space.Types[from]; ok {
+			found = true
+			if err := space.Rename(from, to); err != nil {
+				return err
+			}
+		}
+	}
+	if !found {
+		return fmt.Errorf("type %s not found in state", from)
+	}
+	return nil
+}
+
+// Deprecate marks or unmarks a type as deprecated in every ID space it
+// appears in.
+func (s *State) Deprecate(t structer.TypeName, deprecated bool) error {
+	found := false
+	for _, space := range s.spaces() {
+		if st, ok := space.Types[t]; ok {
+			found = true
+			st.Deprecated = deprecated
+		}
+	}
+	if !found {
+		return fmt.Errorf("type %s not found in state", t)
+	}
+	return nil
+}
+
+// Namespace migrates the global ID space into a separate space for each
+// interface. Every type keeps its existing ID in each of the interfaces it
+// implements, so data that has already been stored can still be read, and
+// the global tombstones are copied to every interface. New types then get
+// the next free ID in each interface's own space.
+//
+// Types without interface metadata, i.e. those from a legacy state file that
+// has not been through a generator run since it was upgraded, cannot be
+// placed and cause an error.
+func (s *State) Namespace() error {
+	if s.Namespaced {
+		return nil
+	}
+
+	var unknown []string
+	for _, tn := range s.StateSpace.SortedNames() {
+		if len(s.Types[tn].Ifaces) == 0 {
+			unknown = append(unknown, tn.String())
+		}
+	}
+	if len(unknown) > 0 {
+		return errors.Errorf("cannot namespace state; these types have no interface recorded, run the generator first:\n  %s",
+			strings.Join(unknown, "\n  "))
+	}
+
+	s.Namespaced = true
+	for tn, st := range s.Types {
+		for _, is := range st.Ifaces {
+			iface, err := structer.ParseTypeName(is)
+			if err != nil {
+				return err
+			}
+			space := s.Space(iface)
+			cp := *st
+			cp.Ifaces = []string{is}
+			space.Types[tn] = &cp
+		}
+	}
+	for _, space := range s.Ifaces {
+		space.Retired = append(space.Retired, s.Retired...)
+		if err := space.init(); err != nil {
+			return err
+		}
+	}
+
+	s.StateSpace = StateSpace{}
+	return s.StateSpace.init()
+}
+
+func (s *StateSpace) init() error {
 	if s.Types == nil {
 		s.Types = make(StateTypes)
 	}
@@ -94,20 +543,44 @@ func (s *State) Init() error {
 	seen := make(map[int]bool)
 
 	max := 0
-	for _, id := range s.Types {
-		if id > max {
-			max = id
+	for _, st := range s.Types {
+		if st.ID > max {
+			max = st.ID
 		}
-		if seen[id] {
-			return fmt.Errorf("duplicate ID %d", id)
+		if seen[st.ID] {
+			return fmt.Errorf("duplicate ID %d", st.ID)
 		}
-		seen[id] = true
+		seen[st.ID] = true
 	}
-	s.NextID = max + 1
+	for _, r := range s.Retired {
+		if r.ID > max {
+			max = r.ID
+		}
+		if seen[r.ID] {
+			return fmt.Errorf("ID %d was retired from %s but is in use", r.ID, r.Type)
+		}
+		seen[r.ID] = true
+	}
+	if s.NextID <= max {
+		s.NextID = max + 1
+	}
+	sort.Slice(s.Retired, func(i, j int) bool {
+		return s.Retired[i].ID < s.Retired[j].ID
+	})
 	return nil
 }
 
-func (s *State) SortedNames() []structer.TypeName {
+// IsRetired reports whether the ID has been retired.
+func (s *StateSpace) IsRetired(id int) (RetiredID, bool) {
+	for _, r := range s.Retired {
+		if r.ID == id {
+			return r, true
+		}
+	}
+	return RetiredID{}, false
+}
+
+func (s *StateSpace) SortedNames() []structer.TypeName {
 	names := make([]structer.TypeName, len(s.Types))
 	i := 0
 	for name := range s.Types {
@@ -120,11 +593,85 @@ func (s *State) SortedNames() []structer.TypeName {
 	return names
 }
 
-func (s *State) EnsureType(t structer.TypeName) (int, error) {
-	if id, ok := s.Types[t]; ok {
-		return id, nil
+// TypeID returns the ID assigned to the type.
+func (s *StateSpace) TypeID(t structer.TypeName) (int, bool) {
+	if st, ok := s.Types[t]; ok {
+		return st.ID, true
 	}
-	s.Types[t] = s.NextID
+	return 0, false
+}
+
+func (s *StateSpace) ensure(t structer.TypeName, iface structer.TypeName) (int, error) {
+	if st, ok := s.Types[t]; ok {
+		st.addIface(iface)
+		return st.ID, nil
+	}
+	st := &StateType{ID: s.NextID, Added: stateNow().UTC().Format("2006-01-02")}
+	st.addIface(iface)
+	s.Types[t] = st
 	s.NextID++
-	return s.Types[t], nil
+	return st.ID, nil
+}
+
+// Set assigns an ID to a type that does not have one yet. It fails if the
+// ID belongs to another type or has been retired, or if the type already has
+// a different ID, as data encoded with the old ID would no longer decode.
+func (s *StateSpace) Set(t structer.TypeName, id int) error {
+	if id <= 0 {
+		return fmt.Errorf("invalid ID %d for %s; IDs must be positive", id, t)
+	}
+	if st, ok := s.Types[t]; ok {
+		if st.ID == id {
+			return nil
+		}
+		return fmt.Errorf("%s already has ID %d; retire it first to give it a new ID, or use mv to move its ID to another type", t, st.ID)
+	}
+	for tn, st := range s.Types {
+		if st.ID == id && tn != t {
+			return fmt.Errorf("ID %d is already assigned to %s", id, tn)
+		}
+	}
+	if r, ok := s.IsRetired(id); ok {
+		return fmt.Errorf("ID %d was retired from %s and cannot be reused", id, r.Type)
+	}
+	s.Types[t] = &StateType{ID: id, Added: stateNow().UTC().Format("2006-01-02")}
+	if id >= s.NextID {
+		s.NextID = id + 1
+	}
+	return nil
+}
+
+// Retire removes a type, keeping its ID as a tombstone so it is never
+// assigned to another type.
+func (s *StateSpace) Retire(t structer.TypeName) error {
+	st, ok := s.Types[t]
+	if !ok {
+		return fmt.Errorf("type %s not found in state", t)
+	}
+	delete(s.Types, t)
+	s.Retired = append(s.Retired, RetiredID{
+		ID:      st.ID,
+		Type:    t.String(),
+		Retired: stateNow().UTC().Format("2006-01-02"),
+	})
+	sort.Slice(s.Retired, func(i, j int) bool {
+		return s.Retired[i].ID < s.Retired[j].ID
+	})
+	return nil
+}
+
+// Rename moves a type's entry to a new name, keeping its ID and recording the
+// old name in Formerly.
+func (s *StateSpace) Rename(from, to structer.TypeName) error {
+	st, ok := s.Types[from]
+	if !ok {
+		return fmt.Errorf("type %s not found in state", from)
+	}
+	if _, ok := s.Types[to]; ok {
+		return fmt.Errorf("cannot rename %s to %s; %s already has an ID", from, to, to)
+	}
+	delete(s.Types, from)
+	st.Formerly = append(st.Formerly, from.String())
+	s.Types[to] = st
+	return nil
 }
@@ -0,0 +1,106 @@
+package msgpgen
+
+import (
+	"bytes"
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/shabbyrobe/structer"
+)
+
+func TestStateLegacyMigration(t *testing.T) {
+	dir, err := ioutil.TempDir("", "msgpgen-state-")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	// the original layout mapped each type straight to its ID
+	file := filepath.Join(dir, "state.json")
+	legacy := `{"Types": {"github.com/foo/pkg.A": 1, "github.com/foo/pkg.B": 3}}`
+	if err := ioutil.WriteFile(file, []byte(legacy), 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	state, err := LoadStateFromFile(file)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if state.Version != StateVersion {
+		t.Fatalf("version %d != %d", state.Version, StateVersion)
+	}
+	if ids := stateIDs(&state.StateSpace); ids["github.com/foo/pkg.A"] != 1 || ids["github.com/foo/pkg.B"] != 3 || len(ids) != 2 {
+		t.Fatal(ids)
+	}
+	if state.NextID != 4 {
+		t.Fatalf("NextID %d != 4", state.NextID)
+	}
+
+	b, err := state.Marshal()
+	if err != nil {
+		t.Fatal(err)
+	}
+	var raw struct {
+		Version int
+		Types   map[string]json.RawMessage
+	}
+	if err := json.Unmarshal(b, &raw); err != nil {
+		t.Fatal(err)
+	}
+	if raw.Version != StateVersion {
+		t.Fatalf("saved version %d != %d", raw.Version, StateVersion)
+	}
+	if entry := bytes.TrimSpace(raw.Types["github.com/foo/pkg.B"]); len(entry) == 0 || entry[0] != '{' {
+		t.Fatalf("entry not upgraded: %s", entry)
+	}
+
+	reloaded := testState(t, string(b))
+	if ids := stateIDs(&reloaded.StateSpace); ids["github.com/foo/pkg.B"] != 3 {
+		t.Fatal(ids)
+	}
+}
+
+func TestStateSpaceSet(t *testing.T) {
+	defer func(now func() time.Time) { stateNow = now }(stateNow)
+	stateNow = func() time.Time { return time.Date(2020, 1, 2, 0, 0, 0, 0, time.UTC) }
+
+	state := testState(t, `{"Types": {"p.A": 1}, "Retired": [{"ID": 2, "Type": "p.Old"}]}`)
+	space := &state.StateSpace
+	a := structer.TypeName{PackagePath: "p", Name: "A"}
+	b := structer.TypeName{PackagePath: "p", Name: "B"}
+
+	for _, tc := range []struct {
+		tn  structer.TypeName
+		id  int
+		err string
+	}{
+		{tn: a, id: 1},
+		{tn: a, id: 5, err: "already has ID 1"},
+		{tn: b, id: 1, err: "already assigned to p.A"},
+		{tn: b, id: 2, err: "retired from p.Old"},
+		{tn: b, id: 0, err: "must be positive"},
+		{tn: b, id: 7},
+	} {
+		err := space.Set(tc.tn, tc.id)
+		if tc.err == "" && err != nil {
+			t.Fatalf("%s=%d: %v", tc.tn, tc.id, err)
+		} else if tc.err != "" && (err == nil || !strings.Contains(err.Error(), tc.err)) {
+			t.Fatalf("%s=%d: expected error containing %q, found %v", tc.tn, tc.id, tc.err, err)
+		}
+	}
+
+	if space.Types[a].ID != 1 {
+		t.Fatalf("A was renumbered to %d", space.Types[a].ID)
+	}
+	if st := space.Types[b]; st.ID != 7 || st.Added != "2020-01-02" {
+		t.Fatalf("unexpected entry for B: %+v", st)
+	}
+	if space.NextID != 8 {
+		t.Fatalf("NextID %d != 8", space.NextID)
+	}
+}
@@ -0,0 +1,213 @@
+package msgpgen
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+
+	"github.com/shabbyrobe/structer"
+)
+
+type StateProblemKind string
+
+const (
+	// The type named by a state entry could not be found.
+	StateTypeMissing StateProblemKind = "missing"
+
+	// The type exists but no longer implements any intercepted interface
+	// that its ID space belongs to.
+	StateNotImplementer StateProblemKind = "not-implementer"
+
+	// More than one entry, or an entry and a tombstone, share an ID.
+	StateDuplicateID StateProblemKind = "duplicate-id"
+
+	// An implementer of an intercepted interface has no ID in the state.
+	StateUnassigned StateProblemKind = "unassigned"
+)
+
+// StateProblem is a disagreement between the state file and the code.
+type StateProblem struct {
+	Kind StateProblemKind
+	Type structer.TypeName
+
+	// The interface whose ID space the problem was found in. Empty for the
+	// global space.
+	Iface structer.TypeName
+
+	ID int
+
+	// For duplicate IDs, the other entry with the same ID.
+	Other string
+}
+
+func (p StateProblem) String() string {
+	var msg string
+	switch p.Kind {
+	case StateTypeMissing:
+		msg = fmt.Sprintf("%s (ID %d) no longer exists", p.Type, p.ID)
+	case StateNotImplementer:
+		msg = fmt.Sprintf("%s (ID %d) no longer implements an intercepted interface", p.Type, p.ID)
+	case StateDuplicateID:
+		msg = fmt.Sprintf("%s has ID %d, which is also used by %s", p.Type, p.ID, p.Other)
+	case StateUnassigned:
+		msg = fmt.Sprintf("%s implements %s but has no ID", p.Type, p.Iface)
+	default:
+		msg = fmt.Sprintf("%s: %s", p.Type, p.Kind)
+	}
+	if p.Iface.Name != "" && p.Kind != StateUnassigned {
+		msg += fmt.Sprintf(" [%s]", p.Iface)
+	}
+	return msg
+}
+
+// StateProblemsError is returned by Generate if Config.StrictState is set
+// and the state disagrees with the code.
+type StateProblemsError struct {
+	Problems []StateProblem
+}
+
+func (s *StateProblemsError) Error() string {
+	msgs := make([]string, len(s.Problems))
+	for i, p := range s.Problems {
+		msgs[i] = p.String()
+	}
+	return fmt.Sprintf("state file does not match the code:\n  %s", strings.Join(msgs, "\n  "))
+}
+
+// DuplicateIDs returns an entry for each type whose ID is shared with another
+// type or a tombstone in the same space. Init refuses to load a state with
+// duplicates, so this should be used on a state returned by ReadStateFile.
+func (s *State) DuplicateIDs() []StateProblem {
+	var problems []StateProblem
+	check := func(iface structer.TypeName, space *StateSpace) {
+		owners := make(map[int]string)
+		for _, r := range space.Retired {
+			owners[r.ID] = r.Type + " (retired)"
+		}
+		for _, tn := range space.SortedNames() {
+			st := space.Types[tn]
+			if other, ok := owners[st.ID]; ok {
+				problems = append(problems, StateProblem{
+					Kind: StateDuplicateID, Type: tn, Iface: iface, ID: st.ID, Other: other,
+				})
+				continue
+			}
+			owners[st.ID] = tn.String()
+		}
+	}
+
+	check(structer.TypeName{}, &s.StateSpace)
+	for _, iface := range s.SortedIfaces() {
+		check(iface, s.Ifaces[iface])
+	}
+	return problems
+}
+
+// ValidateState compares the state with the implementers found by Extract.
+// The state should be the one that was loaded, before Extract assigned IDs
+// to new implementers; pass a copy made with Clone to Extract.
+//
+// Entries moved to a new name by a //msgp:formerly directive during the
+// extraction are treated as if the move had already been saved.
+//
+// A state file may be shared by several runs that each intercept different
+// interfaces, so entries are only reported as StateNotImplementer if they
+// were recorded against an interface found by this extraction. Entries
+// with no recorded interfaces are never reported as such.
+func ValidateState(tpset *structer.TypePackageSet, state *State, extn *Extraction) []StateProblem {
+	var problems []StateProblem
+
+	implements := func(iface, tn structer.TypeName) bool {
+		for _, impl := range extn.Interfaces[iface] {
+			if impl == tn {
+				return true
+			}
+		}
+		return false
+	}
+
+	// former and new names of renamed entries, by ID space
+	type spaceName struct{ iface, tn structer.TypeName }
+	renamedFrom := make(map[spaceName]bool)
+	renamedTo := make(map[spaceName]bool)
+	for _, r := range extn.Renamed {
+		renamedFrom[spaceName{r.Iface, r.From}] = true
+		renamedTo[spaceName{r.Iface, r.To}] = true
+	}
+
+	inRun := make(map[string]bool, len(extn.Interfaces))
+	for iface := range extn.Interfaces {
+		inRun[iface.String()] = true
+	}
+
+	check := func(iface structer.TypeName, space *StateSpace) {
+		for _, tn := range space.SortedNames() {
+			st := space.Types[tn]
+			if renamedFrom[spaceName{iface, tn}] {
+				continue
+			}
+			if tpset.FindObject(tn) == nil {
+				problems = append(problems, StateProblem{Kind: StateTypeMissing, Type: tn, Iface: iface, ID: st.ID})
+				continue
+			}
+
+			found := false
+			if iface.Name != "" {
+				found = !inRun[iface.String()] || implements(iface, tn)
+			} else {
+				// Entries that belong only to interfaces outside this run
+				// can't be checked here.
+				found = true
+				for _, i := range st.Ifaces {
+					if inRun[i] {
+						found = false
+						break
+					}
+				}
+				if !found {
+					for i := range extn.Interfaces {
+						if implements(i, tn) {
+							found = true
+							break
+						}
+					}
+				}
+			}
+			if !found {
+				problems = append(problems, StateProblem{Kind: StateNotImplementer, Type: tn, Iface: iface, ID: st.ID})
+			}
+		}
+	}
+
+	check(structer.TypeName{}, &state.StateSpace)
+	for _, iface := range state.SortedIfaces() {
+		check(iface, state.Ifaces[iface])
+	}
+
+	ifaces := make([]structer.TypeName, 0, len(extn.Interfaces))
+	for iface := range extn.Interfaces {
+		ifaces = append(ifaces, iface)
+	}
+	sort.Slice(ifaces, func(i, j int) bool {
+		return ifaces[i].String() < ifaces[j].String()
+	})
+	for _, iface := range ifaces {
+		space, key := &state.StateSpace, structer.TypeName{}
+		if state.Namespaced {
+			space, key = state.Ifaces[iface], iface
+		}
+		for _, impl := range extn.Interfaces[iface] {
+			if renamedTo[spaceName{key, impl}] {
+				continue
+			}
+			if space != nil {
+				if _, ok := space.Types[impl]; ok {
+					continue
+				}
+			}
+			problems = append(problems, StateProblem{Kind: StateUnassigned, Type: impl, Iface: iface})
+		}
+	}
+
+	return problems
+}
@@ -2,7 +2,7 @@ package msgpgen
 
 import (
 	"go/types"
-	"log"
+	"strings"
 
 	"github.com/pkg/errors"
 	"github.com/shabbyrobe/structer"
@@ -12,9 +12,18 @@ type msgpTypeVisitor struct {
 	structer.PartialTypeVisitor
 
 	currentPkg string
+	current    structer.TypeName
 	tpset      *structer.TypePackageSet
 	typeQueue  *TypeQueue
 	queueItem  *TypeQueueItem
+	log        Log
+
+	// if set, every reference to a named type is added as an edge. edgeFrom
+	// is the type holding the reference and fields is the stack of field
+	// names leading to it.
+	graph    *Graph
+	edgeFrom string
+	fields   []string
 }
 
 func newMsgpTypeVisitor(tpset *structer.TypePackageSet, typeQueue *TypeQueue) *msgpTypeVisitor {
@@ -39,19 +48,23 @@ func newMsgpTypeVisitor(tpset *structer.TypePackageSet, typeQueue *TypeQueue) *m
 		return nil
 	}
 	mtv.PartialTypeVisitor.EnterFieldFunc = func(ctx structer.WalkContext, s structer.StructInfo, field *types.Var, tag string) error {
+		mtv.fields = append(mtv.fields, field.Name())
 		return nil
 	}
 	mtv.PartialTypeVisitor.LeaveFieldFunc = func(ctx structer.WalkContext, s structer.StructInfo, field *types.Var, tag string) error {
+		if len(mtv.fields) > 0 {
+			mtv.fields = mtv.fields[:len(mtv.fields)-1]
+		}
 		return nil
 	}
 
 	mtv.PartialTypeVisitor.VisitBasicFunc = func(ctx structer.WalkContext, t *types.Basic) error {
-		mtv.typeQueue.AddType(mtv.currentPkg, t.String(), t).SetParents(mtv.queueItem.Parents)
+		mtv.typeQueue.AddType(mtv.currentPkg, t.String(), t).SetParents(mtv.parents())
 		return nil
 	}
 
 	mtv.PartialTypeVisitor.VisitInvalidFunc = func(ctx structer.WalkContext, root structer.TypeName, t *types.Basic) error {
-		log.Printf("visited invalid type from root %s: %s", root, mtv.queueItem)
+		wlog(mtv.log, LogWarn, LogExtract, LogGeneral, "visited invalid type from root %s: %s", root, mtv.queueItem)
 		// we should not see Basic types here - it should be caught further up
 		// when we check the directly supported primitives.
 		// panic(fmt.Errorf("unsupported basic type: %s %T:\n%s", ft.Underlying(), ft, tqi))
@@ -59,7 +72,8 @@ func newMsgpTypeVisitor(tpset *structer.TypePackageSet, typeQueue *TypeQueue) *m
 	}
 
 	mtv.PartialTypeVisitor.VisitNamedFunc = func(ctx structer.WalkContext, t *types.Named) error {
-		mtv.typeQueue.AddType(mtv.currentPkg, t.String(), t).SetParents(mtv.queueItem.Parents)
+		mtv.typeQueue.AddType(mtv.currentPkg, t.String(), t).SetParents(mtv.parents())
+		mtv.addEdge(t.String())
 
 		if isNamedCompoundType(t) {
 			// Compound named types need to be walked as well, i.e.
@@ -70,7 +84,14 @@ func newMsgpTypeVisitor(tpset *structer.TypePackageSet, typeQueue *TypeQueue) *m
 			if err != nil {
 				return errors.Wrapf(err, "msgpgen: could not parse named compound type %s", t.String())
 			}
-			return structer.Walk(tn, t.Underlying(), mtv)
+
+			// references found inside the compound type belong to it, not to
+			// the struct field we found it in.
+			from, fields := mtv.edgeFrom, mtv.fields
+			mtv.edgeFrom, mtv.fields = t.String(), nil
+			err = structer.Walk(tn, t.Underlying(), mtv)
+			mtv.edgeFrom, mtv.fields = from, fields
+			return err
 		}
 		return nil
 	}
@@ -78,11 +99,32 @@ func newMsgpTypeVisitor(tpset *structer.TypePackageSet, typeQueue *TypeQueue) *m
 	return mtv
 }
 
+func (t *msgpTypeVisitor) addEdge(to string) {
+	if t.graph == nil {
+		return
+	}
+	label := "elem"
+	if len(t.fields) > 0 {
+		label = strings.Join(t.fields, ".")
+	}
+	t.graph.addEdge(t.edgeFrom, to, label)
+}
+
+// parents returns the chain for types found while walking the current type:
+// the current item's parents followed by the current type itself.
+func (t *msgpTypeVisitor) parents() TypeParents {
+	return t.queueItem.Parents.Next(t.current)
+}
+
 func (t *msgpTypeVisitor) walk(name structer.TypeName, underlying types.Type, tqi *TypeQueueItem) error {
 	t.currentPkg = name.PackagePath
+	t.current = name
 	t.queueItem = tqi
+	t.edgeFrom = name.String()
 	err := structer.Walk(name, underlying, t)
 	t.currentPkg = ""
+	t.current = structer.TypeName{}
 	t.queueItem = nil
+	t.edgeFrom, t.fields = "", nil
 	return err
 }
@@ -0,0 +1,27 @@
+// Package flat is generated into by TestGenerateFlat; its own test only
+// builds once the generated code is in place.
+package flat
+
+//msgp:envelope Msg layout:flat
+
+type Msg interface {
+	msg()
+}
+
+type Created struct {
+	Name string
+	Tags []string
+}
+
+func (c *Created) msg() {}
+
+type Deleted struct {
+	ID int64
+}
+
+func (d Deleted) msg() {}
+
+type Envelope struct {
+	One  Msg
+	Many []Msg
+}
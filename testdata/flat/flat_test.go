@@ -0,0 +1,75 @@
+package flat
+
+import (
+	"bytes"
+	"reflect"
+	"testing"
+
+	"github.com/tinylib/msgp/msgp"
+)
+
+func TestRoundTrip(t *testing.T) {
+	in := Envelope{
+		One:  &Created{Name: "one", Tags: []string{"a", "b"}},
+		Many: []Msg{Deleted{ID: 1 << 40}, &Created{Name: "two", Tags: []string{"c"}}, nil},
+	}
+
+	bts, err := in.MarshalMsg(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var out Envelope
+	if _, err := out.UnmarshalMsg(bts); err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(in, out) {
+		t.Fatalf("UnmarshalMsg: %#v != %#v", out, in)
+	}
+
+	var buf bytes.Buffer
+	if err := msgp.Encode(&buf, &in); err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(buf.Bytes(), bts) {
+		t.Fatalf("EncodeMsg and MarshalMsg disagree")
+	}
+	out = Envelope{}
+	if err := msgp.Decode(&buf, &out); err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(in, out) {
+		t.Fatalf("DecodeMsg: %#v != %#v", out, in)
+	}
+}
+
+func TestFlatLayout(t *testing.T) {
+	bts, err := (&Envelope{One: &Created{Name: "one"}}).MarshalMsg(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Envelope is a tuple, so One is its first element
+	if _, bts, err = msgp.ReadArrayHeaderBytes(bts); err != nil {
+		t.Fatal(err)
+	}
+	sz, bts, err := msgp.ReadMapHeaderBytes(bts)
+	if err != nil {
+		t.Fatalf("Created was not written as a map: %v", err)
+	}
+	keys := make(map[string]bool)
+	for ; sz > 0; sz-- {
+		var key []byte
+		if key, bts, err = msgp.ReadMapKeyZC(bts); err != nil {
+			t.Fatal(err)
+		}
+		keys[string(key)] = true
+		if bts, err = msgp.Skip(bts); err != nil {
+			t.Fatal(err)
+		}
+	}
+	for _, key := range []string{"Name", "Tags", "t"} {
+		if !keys[key] {
+			t.Fatalf("key %q missing from %v", key, keys)
+		}
+	}
+}
@@ -0,0 +1,42 @@
+// Package globals is generated into by TestGenerateGlobals, which shims
+// stamp.Stamp and ignores Token with global directives.
+package globals
+
+import (
+	"github.com/shabbyrobe/msgpgen/testdata/globals/stamp"
+	"github.com/tinylib/msgp/msgp"
+)
+
+type Record struct {
+	Name  string
+	At    stamp.Stamp
+	Token Token
+}
+
+// Token encodes itself; the global ignore stops msgpgen generating methods
+// for it.
+type Token struct {
+	Value string
+}
+
+func (t Token) MarshalMsg(b []byte) ([]byte, error) {
+	return msgp.AppendString(b, t.Value), nil
+}
+
+func (t *Token) UnmarshalMsg(b []byte) (o []byte, err error) {
+	t.Value, o, err = msgp.ReadStringBytes(b)
+	return o, err
+}
+
+func (t Token) EncodeMsg(en *msgp.Writer) error {
+	return en.WriteString(t.Value)
+}
+
+func (t *Token) DecodeMsg(dc *msgp.Reader) (err error) {
+	t.Value, err = dc.ReadString()
+	return err
+}
+
+func (t Token) Msgsize() int {
+	return msgp.StringPrefixSize + len(t.Value)
+}
@@ -0,0 +1,41 @@
+package globals
+
+import (
+	"bytes"
+	"reflect"
+	"testing"
+
+	"github.com/shabbyrobe/msgpgen/testdata/globals/stamp"
+	"github.com/tinylib/msgp/msgp"
+)
+
+func TestRoundTrip(t *testing.T) {
+	in := Record{Name: "one", At: stamp.New(1 << 40), Token: Token{Value: "tok"}}
+
+	bts, err := in.MarshalMsg(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var out Record
+	if _, err := out.UnmarshalMsg(bts); err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(in, out) {
+		t.Fatalf("UnmarshalMsg: %#v != %#v", out, in)
+	}
+
+	var buf bytes.Buffer
+	if err := msgp.Encode(&buf, &in); err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(buf.Bytes(), bts) {
+		t.Fatalf("EncodeMsg and MarshalMsg disagree")
+	}
+	out = Record{}
+	if err := msgp.Decode(&buf, &out); err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(in, out) {
+		t.Fatalf("DecodeMsg: %#v != %#v", out, in)
+	}
+}
@@ -0,0 +1,13 @@
+// Package stamp declares a type that TestGenerateGlobals shims with a global
+// directive rather than one in the package that uses it.
+package stamp
+
+type Stamp struct {
+	sec int64
+}
+
+func New(sec int64) Stamp { return Stamp{sec: sec} }
+
+func ToInt64(s Stamp) int64 { return s.sec }
+
+func FromInt64(sec int64) Stamp { return Stamp{sec: sec} }
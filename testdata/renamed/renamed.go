@@ -0,0 +1,18 @@
+// Package renamed is generated into by TestGenerateStrictStateFormerly. The
+// state it is generated with still knows Created by its old name.
+package renamed
+
+type Msg interface {
+	msg()
+}
+
+//msgp:formerly Created github.com/shabbyrobe/msgpgen/testdata/renamed.OldCreated
+type Created struct {
+	Name string
+}
+
+func (c *Created) msg() {}
+
+type Envelope struct {
+	One Msg
+}
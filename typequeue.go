@@ -3,6 +3,7 @@ package msgpgen
 import (
 	"fmt"
 	"go/types"
+	"strings"
 
 	"github.com/shabbyrobe/structer"
 )
@@ -95,6 +96,15 @@ func (t TypeParents) Next(tn structer.TypeName) TypeParents {
 	return parents
 }
 
+// String returns the parent chain in the form "a/b.Root -> c/d.Child".
+func (t TypeParents) String() string {
+	parts := make([]string, len(t))
+	for i, p := range t {
+		parts[i] = p.String()
+	}
+	return strings.Join(parts, " -> ")
+}
+
 func (t TypeParents) Clone() TypeParents {
 	parents := make(TypeParents, len(t))
 	for i, p := range t {
@@ -118,6 +128,15 @@ func (tqi *TypeQueueItem) SetParents(parents []structer.TypeName) *TypeQueueItem
 	return tqi
 }
 
+// Path returns the chain of types that led to this item, ending with the item
+// itself.
+func (tqi *TypeQueueItem) Path() string {
+	if len(tqi.Parents) == 0 {
+		return tqi.Name
+	}
+	return tqi.Parents.String() + " -> " + tqi.Name
+}
+
 func (tqi *TypeQueueItem) Key() string {
 	return fmt.Sprintf("%s:%s", tqi.OriginPkg, tqi.Name)
 }
@@ -127,13 +146,7 @@ func (tqi *TypeQueueItem) String() string {
 	out += "\n  origin: " + tqi.OriginPkg
 	out += "\n  name: " + tqi.Name
 	if len(tqi.Parents) > 0 {
-		out += "\n  parents: "
-		for i, parent := range tqi.Parents {
-			if i > 0 {
-				out += " -> "
-			}
-			out += parent.String()
-		}
+		out += "\n  parents: " + tqi.Parents.String()
 	}
 	if tqi.Type != nil {
 		out += "\n  type: " + tqi.Type.String()